@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// appliedListPath returns the file in the settings dir holding the MD5s of
+// the filelist last fully applied to rootPath.
+func appliedListPath(rootPath string) string {
+	abs, err := filepath.Abs(rootPath)
+	if err != nil {
+		abs = rootPath
+	}
+	return filepath.Join(getSettingsRoot(), "applied_"+md5OfData([]byte(abs))[:8]+".txt")
+}
+
+// writeAppliedList saves the MD5s of the downloads of list in the format of
+// md5sum, for --keep-user-modified.
+func writeAppliedList(rootPath string, list *fileListYaml) error {
+	var sb strings.Builder
+	for _, dl := range list.allDownloads {
+		sb.WriteString(dl.MD5 + "  " + dl.Name + "\n")
+	}
+	return writeFile(appliedListPath(rootPath), []byte(sb.String()))
+}
+
+// readAppliedList returns the MD5s by name of the filelist last fully
+// applied to rootPath, or nil if there is none.
+func readAppliedList(rootPath string) map[string]string {
+	data, err := os.ReadFile(appliedListPath(rootPath))
+	if err != nil {
+		return nil
+	}
+	hashes := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if sum, name, ok := strings.Cut(line, "  "); ok {
+			hashes[name] = sum
+		}
+	}
+	return hashes
+}
+
+// userModified reports whether the local file of dl, having localMD5, was
+// likely changed by the user: it matches neither dl nor the entry of the
+// previously applied filelist.
+func userModified(dl fileEntry, localMD5 string, applied map[string]string) bool {
+	previous, ok := applied[dl.Name]
+	return ok && localMD5 != dl.MD5 && localMD5 != previous
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepUserModified(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"ui.ini": "v1 ui", "eqgame.dll": "v1 game"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+	settings := settingsRoot
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// the user customizes ui.ini and adds a file the next version brings
+	writeTestFiles(t, rootPath, map[string]string{"ui.ini": "custom ui", "new.txt": "user's own"})
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		list.Version = "2"
+		list.Downloads = nil
+		for name, content := range map[string]string{"eqgame.dll": "v2 game", "new.txt": "v2 new", "ui.ini": "v2 ui"} {
+			files[name] = []byte(content)
+			list.Downloads = append(list.Downloads, fileEntry{Name: name, MD5: md5Hex(content), Size: uint(len(content))})
+		}
+	})
+
+	out := setupTest(t, srv.patchArgs(rootPath, "--keep-user-modified", "--refresh-manifest")...)
+	settingsRoot = settings
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// only files matching the previous version are outdated, files it
+	// didn't have can't tell
+	for name, want := range map[string]string{"ui.ini": "custom ui", "eqgame.dll": "v2 game", "new.txt": "v2 new"} {
+		if got := readTestFile(t, rootPath, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if !strings.Contains(out.String(), "WARNING: keeping ui.ini, it was modified since the last update") {
+		t.Errorf("kept file not reported:\n%s", out)
+	}
+
+	// without the option, it is overwritten
+	setupTest(t, srv.patchArgs(rootPath)...)
+	settingsRoot = settings
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, rootPath, "ui.ini"); got != "v2 ui" {
+		t.Errorf("ui.ini = %q without --keep-user-modified, want v2 ui", got)
+	}
+}
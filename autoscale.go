@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often --workers-auto re-evaluates the number of parallel downloads
+const autoScaleInterval = 2 * time.Second
+
+// total bytes received by all fetches, sampled by --workers-auto
+var receivedBytes atomic.Int64
+
+// workerScaler limits how many workers of the pool may download at once.
+// With --workers-auto the limit starts at 1 and is raised while throughput
+// improves, up to the pool size.
+type workerScaler struct {
+	max int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	active   int
+	failures int
+}
+
+func newWorkerScaler(max int, auto bool) *workerScaler {
+	s := &workerScaler{max: max, limit: max}
+	if auto {
+		s.limit = 1
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *workerScaler) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+}
+
+func (s *workerScaler) release(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if err != nil {
+		s.failures++
+	}
+	s.cond.Broadcast()
+}
+
+// run adjusts the limit every autoScaleInterval until done is closed.
+func (s *workerScaler) run(done <-chan struct{}) {
+	defer writeCrashDiagnostics()
+	ticker := time.NewTicker(autoScaleInterval)
+	defer ticker.Stop()
+	lastBytes := receivedBytes.Load()
+	lastRate := 0.0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		bytes := receivedBytes.Load()
+		rate := float64(bytes-lastBytes) / autoScaleInterval.Seconds()
+		lastBytes = bytes
+
+		s.mu.Lock()
+		limit := nextWorkerLimit(s.limit, s.max, rate, lastRate, s.failures)
+		s.failures = 0
+		if limit != s.limit && arg.Verbose {
+			reporter.Logf("- Using %d parallel downloads at %s/s", limit, formatBytes(int64(rate)))
+		}
+		s.limit = limit
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		lastRate = rate
+	}
+}
+
+// nextWorkerLimit returns the number of parallel downloads to use next. It
+// halves on failures, grows by one while throughput improves by at least
+// 10% and shrinks by one when it drops, keeping it between 1 and max.
+func nextWorkerLimit(limit, max int, rate, lastRate float64, failures int) int {
+	switch {
+	case failures > 0:
+		limit /= 2
+	case rate > lastRate*1.1:
+		limit++
+	case rate < lastRate*0.9:
+		limit--
+	}
+	if limit > max {
+		limit = max
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestWorkersAutoConvergesBelowBandwidthCeiling(t *testing.T) {
+	// each connection gets 1 MB/s until the line is full at 5 MB/s
+	const perConnection, ceiling = 1 << 20, 5 << 20
+	rateAt := func(limit int) float64 {
+		rate := float64(limit * perConnection)
+		if rate > ceiling {
+			rate = ceiling
+		}
+		return rate
+	}
+
+	s := newWorkerScaler(16, true)
+	if s.limit != 1 {
+		t.Fatalf("started with %d workers, want 1", s.limit)
+	}
+	limit, lastRate := s.limit, 0.0
+	seen := []int{}
+	for i := 0; i < 30; i++ {
+		rate := rateAt(limit)
+		limit = nextWorkerLimit(limit, s.max, rate, lastRate, 0)
+		lastRate = rate
+		seen = append(seen, limit)
+	}
+	for _, l := range seen[20:] {
+		if l < 5 || l > 7 {
+			t.Fatalf("worker limits %v, want to settle between 5 and 7", seen)
+		}
+	}
+
+	if got := nextWorkerLimit(6, 16, ceiling, ceiling, 3); got != 3 {
+		t.Errorf("after failures the limit is %d, want it halved to 3", got)
+	}
+	if got := nextWorkerLimit(1, 16, 0, ceiling, 5); got != 1 {
+		t.Errorf("the limit dropped to %d, want at least 1", got)
+	}
+	if got := nextWorkerLimit(16, 16, 2*ceiling, ceiling, 0); got != 16 {
+		t.Errorf("the limit rose to %d, want at most the pool size", got)
+	}
+	if s := newWorkerScaler(8, false); s.limit != 8 {
+		t.Errorf("without --workers-auto the limit is %d, want 8", s.limit)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// size of the file written and hashed by the benchmark command
+const benchmarkSize = 64 << 20
+
+type benchmarkCmd struct {
+	EverquestRoot string `arg:"" help:"Folder on the volume to benchmark." type:"existingdir"`
+}
+
+// runBenchmark prints the disk write and hashing throughput in rootPath, to
+// tell slow disks from slow networks.
+func runBenchmark(rootPath string) error {
+	write, hash, err := benchmarkVolume(rootPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Disk write: %s/s\n", formatBytes(write))
+	fmt.Fprintf(stdout, "Hashing:    %s/s (file is likely cached in memory)\n", formatBytes(hash))
+	return nil
+}
+
+// benchmarkVolume returns the disk write and hashing throughput in rootPath,
+// in bytes per second.
+func benchmarkVolume(rootPath string) (write, hash int64, err error) {
+	data := make([]byte, benchmarkSize)
+	rand.Read(data)
+
+	f, err := os.CreateTemp(rootPath, ".fvpatcher-benchmark-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	fileName := f.Name()
+	f.Close()
+	defer os.Remove(fileName)
+
+	started := time.Now()
+	if err := writeFile(fileName, data); err != nil {
+		return 0, 0, err
+	}
+	write = throughput(benchmarkSize, time.Since(started))
+
+	started = time.Now()
+	if _, err := md5OfFile(fileName); err != nil {
+		return 0, 0, err
+	}
+	hash = throughput(benchmarkSize, time.Since(started))
+	return write, hash, nil
+}
+
+func throughput(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	return int64(float64(n) / d.Seconds())
+}
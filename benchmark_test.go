@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	rootPath := t.TempDir()
+	out := setupTest(t, "benchmark", rootPath)
+
+	write, hash, err := benchmarkVolume(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// anything from a floppy disk to well beyond current hardware
+	for name, v := range map[string]int64{"write": write, "hash": hash} {
+		if v < 1<<10 || v > 1<<40 {
+			t.Errorf("%s throughput of %d bytes/s is implausible", name, v)
+		}
+	}
+	if entries, _ := os.ReadDir(rootPath); len(entries) != 0 {
+		t.Errorf("%d files left behind", len(entries))
+	}
+
+	if err := runBenchmark(rootPath); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Disk write: ") || !strings.Contains(out.String(), "Hashing: ") {
+		t.Errorf("results not printed:\n%s", out)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "sync"
+
+// failureBreaker trips after limit consecutive failures, assuming a systemic
+// problem such as the server being down. A limit of 0 never trips.
+type failureBreaker struct {
+	limit int
+
+	mu          sync.Mutex
+	consecutive int
+}
+
+func newFailureBreaker(limit int) *failureBreaker {
+	return &failureBreaker{limit: limit}
+}
+
+func (b *failureBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive = 0
+}
+
+func (b *failureBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive++
+}
+
+func (b *failureBreaker) tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit > 0 && b.consecutive >= b.limit
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFailureBreaker(t *testing.T) {
+	b := newFailureBreaker(3)
+	b.failure()
+	b.failure()
+	b.success()
+	b.failure()
+	b.failure()
+	if b.tripped() {
+		t.Fatal("tripped although a success reset the count")
+	}
+	b.failure()
+	if !b.tripped() {
+		t.Fatal("not tripped after 3 failures in a row")
+	}
+
+	never := newFailureBreaker(0)
+	for i := 0; i < 100; i++ {
+		never.failure()
+	}
+	if never.tripped() {
+		t.Fatal("a limit of 0 tripped")
+	}
+}
+
+func TestConsecutiveFailuresAbortRun(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("file%d.txt", i)] = fmt.Sprint("content ", i)
+	}
+	srv := newTestServer(t, files)
+	// the server lost all its files
+	srv.update(func(_ *fileListYaml, files map[string][]byte) {
+		for name := range files {
+			delete(files, name)
+		}
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--workers", "1", "--retries", "0", "--max-consecutive-failures", "3")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Aborted == "" {
+		t.Fatal("the run was not aborted")
+	}
+	if len(report.Failed) != 3 || len(report.Pending) != 7 {
+		t.Errorf("%d failed and %d not started, want 3 and 7", len(report.Failed), len(report.Pending))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bspatch applies a patch in the BSDIFF40 format, as produced by bsdiff, to old.
+// Patches producing more than maxSize bytes are refused.
+func bspatch(old, patch []byte, maxSize int64) ([]byte, error) {
+	if len(patch) < 32 || string(patch[:8]) != "BSDIFF40" {
+		return nil, errors.New("bspatch: not a BSDIFF40 patch")
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	rest := int64(len(patch)) - 32
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || ctrlLen > rest || diffLen > rest-ctrlLen {
+		return nil, errors.New("bspatch: corrupt patch header")
+	}
+	if newSize > maxSize {
+		return nil, fmt.Errorf("bspatch: patched file of %d bytes is larger than the expected %d", newSize, maxSize)
+	}
+
+	ctrlReader := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diffReader := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extraReader := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	newData := make([]byte, newSize)
+	var oldPos, newPos int64
+	buf := make([]byte, 8)
+	for newPos < newSize {
+		var ctrl [3]int64
+		for i := range ctrl {
+			if _, err := io.ReadFull(ctrlReader, buf); err != nil {
+				return nil, fmt.Errorf("bspatch: reading control block: %w", err)
+			}
+			ctrl[i] = offtin(buf)
+		}
+
+		if ctrl[0] < 0 || ctrl[1] < 0 || ctrl[0] > newSize-newPos {
+			return nil, errors.New("bspatch: corrupt control block")
+		}
+		if _, err := io.ReadFull(diffReader, newData[newPos:newPos+ctrl[0]]); err != nil {
+			return nil, fmt.Errorf("bspatch: reading diff block: %w", err)
+		}
+		for i := int64(0); i < ctrl[0]; i++ {
+			if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+				newData[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += ctrl[0]
+		oldPos += ctrl[0]
+
+		if ctrl[1] > newSize-newPos {
+			return nil, errors.New("bspatch: corrupt control block")
+		}
+		if _, err := io.ReadFull(extraReader, newData[newPos:newPos+ctrl[1]]); err != nil {
+			return nil, fmt.Errorf("bspatch: reading extra block: %w", err)
+		}
+		newPos += ctrl[1]
+		oldPos += ctrl[2]
+	}
+	return newData, nil
+}
+
+// offtin decodes the sign-magnitude little endian integers used by bsdiff.
+func offtin(buf []byte) int64 {
+	y := int64(buf[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(buf[i])
+	}
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
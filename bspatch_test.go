@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+const (
+	patchOld = "hello world, this is the old file\n"
+	patchNew = "hello WORLD, this is the new file, patched\n"
+)
+
+// testPatch is a BSDIFF40 patch from patchOld to patchNew.
+func testPatch(t *testing.T) []byte {
+	t.Helper()
+	patch, err := base64.StdEncoding.DecodeString("QlNESUZGNDArAAAAAAAAADgAAAAAAAAAKwAAAAAAAABCWmg5MUFZJlNZBb6DagAABdAASCgQACAAIYaBmgxWybi7kinChIAt9BtQQlpoOTFBWSZTWa7pUYEAAADwAfAQCAAQAEAAACCgADEGTEDI0aaZqRAdHki5PF3JFOFCQrulRgRCWmg5MUFZJlNZJFAWeAAAANGAABBAAC5ARAAgACIBptQgyYjaYwZ4u5IpwoSBIoCzwA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch
+}
+
+func TestBspatch(t *testing.T) {
+	data, err := bspatch([]byte(patchOld), testPatch(t), int64(len(patchNew)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != patchNew {
+		t.Errorf("bspatch() = %q, want %q", data, patchNew)
+	}
+
+	if _, err := bspatch([]byte(patchOld), testPatch(t)[:40], int64(len(patchNew))); err == nil {
+		t.Error("bspatch() of a truncated patch succeeded")
+	}
+	if _, err := bspatch([]byte(patchOld), []byte("not a patch at all, not a patch at all"), int64(len(patchNew))); err == nil {
+		t.Error("bspatch() of garbage succeeded")
+	}
+	if _, err := bspatch([]byte(patchOld), testPatch(t), int64(len(patchNew))-1); err == nil {
+		t.Error("bspatch() beyond the expected size succeeded")
+	}
+}
+
+func TestBspatchCorruptHeader(t *testing.T) {
+	for _, patch := range []string{
+		// lengths whose sum overflows
+		"BSDIFF400000000x0000000000000000",
+		"BSDIFF40\xff\xff\xff\xff\xff\xff\xff\x7f\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		// a new size that would be allocated before reading anything
+		"BSDIFF40\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\xff\xff\xff\x7f",
+	} {
+		if _, err := bspatch([]byte("0"), []byte(patch), 100); err == nil {
+			t.Errorf("bspatch(%q) succeeded", patch)
+		}
+	}
+}
+
+func TestDownloadAppliesPatch(t *testing.T) {
+	for _, local := range []string{patchOld, "some other version\n"} {
+		srv := newTestServer(t, map[string]string{"file.txt": patchNew})
+		srv.update(func(list *fileListYaml, files map[string][]byte) {
+			files["file.txt.bsdiff"] = testPatch(t)
+			list.Downloads[0].Patch = &filePatch{Name: "file.txt.bsdiff", SourceMD5: md5Hex(patchOld)}
+		})
+		rootPath := t.TempDir()
+		writeTestFiles(t, rootPath, map[string]string{"file.txt": local})
+		setupTest(t, srv.patchArgs(rootPath)...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Failed) != 0 {
+			t.Fatalf("failed = %+v", report.Failed)
+		}
+		if got := readTestFile(t, rootPath, "file.txt"); got != patchNew {
+			t.Errorf("file.txt = %q, want %q", got, patchNew)
+		}
+		// the full file is only downloaded if the local file isn't the patch source
+		fullDownloads := srv.requestCount("/files/file.txt")
+		if local == patchOld && fullDownloads != 0 {
+			t.Errorf("downloaded the full file %d times although it could be patched", fullDownloads)
+		}
+		if local != patchOld && fullDownloads != 1 {
+			t.Errorf("downloaded the full file %d times, want a fallback to the full file", fullDownloads)
+		}
+	}
+}
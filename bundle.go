@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// extractFromBundle downloads the manifest's zip bundle and extracts the
+// needed entries from it, verifying each against its MD5. It returns the
+// written entries and those that still need downloading one by one.
+func (list *fileListYaml) extractFromBundle(rootPath string, needed []fileEntry, report *runReport) (written, remaining []fileEntry) {
+	bundleURL := list.DownloadPrefix + list.Bundle
+	reporter.Logf("GET %s", bundleURL)
+	f, err := os.CreateTemp("", "fvpatcher-bundle-*.zip")
+	if err != nil {
+		reporter.Logf("ERROR: %v", err)
+		return nil, needed
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = withRetry(bundleURL, func() error {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return fetchUrlToWriter(bundleURL, f)
+	})
+	if err != nil {
+		reporter.Logf("ERROR: downloading bundle failed, downloading files one by one: %v", err)
+		return nil, needed
+	}
+	info, err := f.Stat()
+	if err != nil {
+		reporter.Logf("ERROR: %v", err)
+		return nil, needed
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		reporter.Logf("ERROR: bundle is not a valid zip, downloading files one by one: %v", err)
+		return nil, needed
+	}
+
+	members := map[string]*zip.File{}
+	for _, zf := range zr.File {
+		members[zf.Name] = zf
+	}
+	for _, dl := range needed {
+		zf, ok := members[dl.Name]
+		if !ok || dl.URL != "" {
+			remaining = append(remaining, dl)
+			continue
+		}
+		data, err := readZipFile(zf)
+		if err == nil {
+			err = checkMD5(data, dl.MD5)
+		}
+		if err != nil {
+			if arg.Verbose {
+				reporter.Logf("- %s in bundle is damaged or outdated, downloading it separately", dl.Name)
+			}
+			remaining = append(remaining, dl)
+			continue
+		}
+		reporter.Logf("EXTRACT %s", dl.Name)
+		if err := list.installFile(filepath.Join(rootPath, dl.Name), data); err != nil {
+			reporter.Logf("ERROR: %v", err)
+			report.addFailure(dl.Name, failFilesystem, err)
+			continue
+		}
+		report.addDownloaded(dl.Name)
+		written = append(written, dl)
+	}
+	return written, remaining
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// fetchUrlToWriter streams the body of url to w.
+func fetchUrlToWriter(url string, w io.Writer) error {
+	response, err := newHTTPClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &httpStatusError{"GET", url, response.StatusCode, response.Status}
+	}
+	reporter.FetchStarted(url)
+	defer reporter.FetchDone(url)
+	_, err = io.Copy(w, &progressReader{r: response.Body, url: url})
+	return err
+}
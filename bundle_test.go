@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// zipFiles returns a zip archive of files, a map of names to content.
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractFromBundle(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"a.txt": "a", "maps/b.eqg": "b", "damaged.txt": "damaged", "separate.txt": "separate", "current.txt": "current",
+	})
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		list.Bundle = "bundle.zip"
+		files["bundle.zip"] = zipFiles(t, map[string]string{
+			"a.txt": "a", "maps/b.eqg": "b", "damaged.txt": "bit rot", "current.txt": "current", "unrelated.txt": "unrelated",
+		})
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"current.txt": "current"})
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	setupTest(t, srv.patchArgs(rootPath, "--bundle-threshold", "2")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	for name, want := range map[string]string{
+		"a.txt": "a", "maps/b.eqg": "b", "damaged.txt": "damaged", "separate.txt": "separate", "unrelated.txt": "<missing>",
+	} {
+		if got := readTestFile(t, rootPath, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for name, want := range map[string]int{
+		"/files/bundle.zip": 1, "/files/a.txt": 0, "/files/maps/b.eqg": 0, "/files/damaged.txt": 1, "/files/separate.txt": 1,
+	} {
+		if got := srv.requestCount(name); got != want {
+			t.Errorf("%s was requested %d times, want %d", name, got, want)
+		}
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Errorf("the bundle was not removed from %s", filepath.Join(tmpDir, entries[0].Name()))
+	}
+}
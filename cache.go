@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestCachePath returns the path of the cached filelist of rootPath,
+// along with its detected expansion and client.
+func manifestCachePath(rootPath string) (string, string, string, error) {
+	expansion, client, err := detectInstall(rootPath, arg.Expansion, arg.Client)
+	if err != nil {
+		return "", "", "", err
+	}
+	if err := validateInstallArgs(expansion, client); err != nil {
+		return "", "", "", err
+	}
+	cachePath := filepath.Join(getSettingsRoot(), manifestCacheName(client, expansion, manifestURL(client, expansion)))
+	return cachePath, expansion, client, nil
+}
+
+// repairManifestCache re-downloads the cached filelist of rootPath, without
+// touching the game files. The cached copy is only replaced once the new one
+// was fetched, so it isn't lost when the server can't be reached.
+func repairManifestCache(rootPath string) error {
+	cachePath, expansion, client, err := manifestCachePath(rootPath)
+	if err != nil {
+		return err
+	}
+	arg.RefreshManifest, arg.AllowStale = true, false
+	list, err := DownloadFileList(client, expansion)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Refreshed", cachePath, "with filelist version", list.Version)
+	return nil
+}
+
+// prefetchManifest makes sure a fresh filelist of rootPath is cached,
+// without scanning or changing the game files.
+func prefetchManifest(rootPath string) error {
+	cachePath, expansion, client, err := manifestCachePath(rootPath)
+	if err != nil {
+		return err
+	}
+	list, err := DownloadFileList(client, expansion)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Cached filelist version", list.Version, "at", cachePath)
+	return nil
+}
+
+// touchManifestCache resets the age of the cached filelist, if there is one.
+func touchManifestCache(client, expansion string) error {
+	cachePath := filepath.Join(getSettingsRoot(), manifestCacheName(client, expansion, manifestURL(client, expansion)))
+	if !fileOrDirExists(cachePath) {
+		return nil
+	}
+	now := time.Now()
+	return os.Chtimes(cachePath, now, now)
+}
+
+// listCache prints the cached filelists in the settings dir.
+func listCache() error {
+	matches, err := filepath.Glob(filepath.Join(getSettingsRoot(), "filelist_*.yml"))
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		fmt.Fprintln(stdout, "No cached filelists in", getSettingsRoot())
+		return nil
+	}
+	for _, fileName := range matches {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return err
+		}
+		client, expansion := "?", "?"
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fileName), "filelist_"), ".yml"), ".")
+		if len(parts) >= 2 {
+			client, expansion = parts[0], parts[1]
+		}
+		version := "unreadable"
+		if list, err := readFileList(fileName); err == nil {
+			version = list.Version
+		}
+		stale := ""
+		if isCachedFileTooOld(fileName, 7) {
+			stale = ", stale"
+		}
+		age := time.Since(info.ModTime()).Round(time.Minute)
+		fmt.Fprintf(stdout, "%s: client %s, expansion %s, version %s, %s, %s old%s\n",
+			filepath.Base(fileName), client, expansion, version, formatBytes(info.Size()), age, stale)
+	}
+	return nil
+}
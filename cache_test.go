@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepairManifestCacheReplacesCache(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+	cachePath, _, _, err := manifestCachePath(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	// the cache is recent, but wrong
+	if err := os.WriteFile(cachePath, []byte("version: \"0\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Version = "2" })
+
+	if err := repairManifestCache(rootPath); err != nil {
+		t.Fatal(err)
+	}
+	list, err := readFileList(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Version != "2" {
+		t.Errorf("cached version is %s after repairing, want 2", list.Version)
+	}
+
+	// the cache is kept if the server can't be reached
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	})
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	settingsRoot = filepath.Dir(cachePath)
+	if err := repairManifestCache(rootPath); err == nil {
+		t.Fatal("repairManifestCache() succeeded without a server")
+	}
+	if list, err := readFileList(cachePath); err != nil || list.Version != "2" {
+		t.Errorf("cache after a failed repair: %v, %v", list, err)
+	}
+}
+
+func TestListCache(t *testing.T) {
+	out := setupTest(t, "list-cache")
+	if err := listCache(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "No cached filelists") {
+		t.Errorf("empty cache not reported:\n%s", out)
+	}
+
+	out = setupTest(t, "list-cache")
+	tests := []struct {
+		name, content, want string
+		stale               bool
+	}{
+		{manifestCacheName("rof", "original", "https://a.example.com/filelist.yml"), "version: \"12\"\n", "client rof, expansion original, version 12,", false},
+		{manifestCacheName("titanium", "pop", "https://b.example.com/filelist.yml"), "version: \"7\"\n", "client titanium, expansion pop, version 7,", true},
+		{manifestCacheName("rof", "broken", "https://c.example.com/filelist.yml"), "version: [\n", "client rof, expansion broken, version unreadable,", false},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(settingsRoot, test.name)
+		if err := os.WriteFile(fileName, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.stale {
+			old := time.Now().Add(-10 * 24 * time.Hour)
+			if err := os.Chtimes(fileName, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := listCache(); err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		name, details, _ := strings.Cut(line, ": ")
+		listed[name] = details
+	}
+	if len(listed) != len(tests) {
+		t.Errorf("listed %d filelists, want %d:\n%s", len(listed), len(tests), out)
+	}
+	for _, test := range tests {
+		details := listed[test.name]
+		if !strings.HasPrefix(details, test.want) || strings.HasSuffix(details, ", stale") != test.stale {
+			t.Errorf("%s listed as %q, want %q, stale %v", test.name, details, test.want, test.stale)
+		}
+	}
+}
+
+func TestPrefetchManifest(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"old.txt": "old"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--prefetch-manifest")...)
+	cachePath, _, _, err := manifestCachePath(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cachedVersion prefetches and returns the version cached
+	cachedVersion := func() string {
+		if err := prefetchManifest(rootPath); err != nil {
+			t.Fatal(err)
+		}
+		list, err := readFileList(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list.Version
+	}
+	if got := cachedVersion(); got != "1" {
+		t.Errorf("cached version %s, want 1", got)
+	}
+	if !strings.Contains(out.String(), "Cached filelist version 1") {
+		t.Errorf("prefetch not reported:\n%s", out)
+	}
+
+	// a fresh cache is kept, unless a refresh is forced
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Version = "2" })
+	if got := cachedVersion(); got != "1" {
+		t.Errorf("cached version %s, want the fresh cache of version 1 kept", got)
+	}
+	arg.RefreshManifest = true
+	if got := cachedVersion(); got != "2" {
+		t.Errorf("cached version %s with --refresh-manifest, want 2", got)
+	}
+
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || readTestFile(t, rootPath, "old.txt") != "old" || srv.requestCount("/files/a.txt") != 0 {
+		t.Error("the install was changed")
+	}
+}
+
+func TestTouchManifestCache(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--touch-manifest-cache")...)
+	settings := settingsRoot
+	cachePath, _, _, err := manifestCachePath(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+
+	// patch ages the cache, runs rootPath with args and reports whether the
+	// cache was touched
+	patch := func(args ...string) bool {
+		t.Helper()
+		setupTest(t, srv.patchArgs(rootPath, args...)...)
+		settingsRoot = settings
+		if err := os.Chtimes(cachePath, hourAgo, hourAgo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime().After(hourAgo)
+	}
+	if patch("--touch-manifest-cache") {
+		t.Error("cache touched by a run that downloaded files")
+	}
+	if !patch("--touch-manifest-cache") {
+		t.Error("cache not touched by a fully current run")
+	}
+	if patch() {
+		t.Error("cache touched without --touch-manifest-cache")
+	}
+
+	// nor when something failed
+	if err := os.Remove(filepath.Join(rootPath, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "b.txt") })
+	if patch("--touch-manifest-cache", "--retries", "0") {
+		t.Error("cache touched by a run with failed downloads")
+	}
+}
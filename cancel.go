@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runCtx is cancelled on the first interrupt, aborting the requests in flight
+// and stopping the downloads of the run. A second interrupt exits at once.
+var runCtx, cancelRun = context.WithCancel(context.Background())
+
+func handleInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		defer writeCrashDiagnostics()
+		<-c
+		reporter.Logf("Interrupted, stopping downloads. Press Ctrl+C again to quit immediately")
+		cancelRun()
+		<-c
+		os.Exit(130)
+	}()
+}
+
+func cancelled() bool {
+	return runCtx.Err() != nil
+}
+
+// sleepUnlessCancelled waits for d, returning early if the run is cancelled.
+func sleepUnlessCancelled(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-runCtx.Done():
+	}
+}
+
+// cancelTransport makes requests fail once the run is cancelled.
+type cancelTransport struct {
+	base http.RoundTripper
+}
+
+func (t cancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(runCtx))
+}
+
+// cancellation lists the state of the downloads of a cancelled run.
+type cancellation struct {
+	Completed []string `json:"completed"`
+	InFlight  []string `json:"in_flight"`
+	Pending   []string `json:"pending"`
+}
+
+func (r *runReport) cancellation() *cancellation {
+	if !r.Cancelled {
+		return nil
+	}
+	return &cancellation{Completed: r.Downloaded, InFlight: r.InFlight, Pending: r.Pending}
+}
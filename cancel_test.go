@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCancelRecordsDownloadStates(t *testing.T) {
+	files := map[string]string{"a.txt": strings.Repeat("a", 100)}
+	for _, name := range []string{"b.txt", "c.txt", "d.txt", "e.txt", "f.txt"} {
+		files[name] = name
+	}
+	srv := newTestServer(t, files)
+	// a.txt is served, the others hang until they are cancelled
+	blocked := make(chan string, len(files))
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/files/") && r.URL.Path != "/files/a.txt" {
+			blocked <- r.URL.Path
+			<-r.Context().Done()
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--workers", "2")...)
+
+	go func() {
+		// a.txt is the largest, so it is downloaded first and the worker
+		// moves on to the next file
+		<-blocked
+		<-blocked
+		cancelRun()
+	}()
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Cancelled {
+		t.Fatal("the run was not cancelled")
+	}
+	if len(report.Downloaded) != 1 || report.Downloaded[0] != "a.txt" {
+		t.Errorf("completed = %q, want a.txt", report.Downloaded)
+	}
+	if len(report.InFlight) != 2 || len(report.Pending) != 3 {
+		t.Errorf("in flight %q and pending %q, want 2 and 3", report.InFlight, report.Pending)
+	}
+	states := append(append(append([]string{}, report.Downloaded...), report.InFlight...), report.Pending...)
+	sort.Strings(states)
+	if strings.Join(states, " ") != "a.txt b.txt c.txt d.txt e.txt f.txt" {
+		t.Errorf("files in any state: %q, want each file once", states)
+	}
+
+	entries := readRunLog(t, filepath.Join(settingsRoot, runLogName))
+	if c := entries[len(entries)-1].Cancelled; c == nil || len(c.Completed) != 1 || len(c.InFlight) != 2 || len(c.Pending) != 3 {
+		t.Errorf("run log has cancellation %+v", c)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// printChecksums prints the MD5, and with --sha256 the SHA-256, of every
+// local file listed in the cached filelist of rootPath, sorted by name in
+// the format of md5sum. It uses neither the network nor changes anything.
+func printChecksums(rootPath string) error {
+	cachePath, _, _, err := manifestCachePath(rootPath)
+	if err != nil {
+		return err
+	}
+	if !fileOrDirExists(cachePath) {
+		return fmt.Errorf("no cached filelist, run once without --checksum-only first")
+	}
+	list, err := readFileList(cachePath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(list.Downloads))
+	for _, dl := range list.Downloads {
+		names = append(names, dl.Name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fullPath := filepath.Join(rootPath, name)
+		if !fileOrDirExists(fullPath) {
+			fmt.Fprintln(stdout, "missing ", name)
+			continue
+		}
+		sum, err := md5OfFile(fullPath)
+		if err != nil {
+			return err
+		}
+		if arg.SHA256 {
+			sha, err := sha256OfFile(fullPath)
+			if err != nil {
+				return err
+			}
+			sum += " " + sha
+		}
+		fmt.Fprintln(stdout, sum+" ", name)
+	}
+	return nil
+}
+
+func sha256OfFile(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrintChecksums(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"b.txt": "b", "a/z.txt": "z", "c.txt": "c", "A.txt": "upper"})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"b.txt": "b", "a/z.txt": "modified", "A.txt": "upper"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--checksum-only")...)
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	// only the cached filelist is used
+	srv.Close()
+
+	// checksums returns what printChecksums prints
+	checksums := func() string {
+		before := len(out.String())
+		if err := printChecksums(rootPath); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()[before:]
+	}
+	want := fmt.Sprintf("%s  A.txt\n%s  a/z.txt\n%s  b.txt\nmissing  c.txt\n", md5Hex("upper"), md5Hex("modified"), md5Hex("b"))
+	for i := 0; i < 2; i++ {
+		if got := checksums(); got != want {
+			t.Errorf("run %d printed:\n%s\nwant:\n%s", i+1, got, want)
+		}
+	}
+
+	arg.SHA256 = true
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte("b")))
+	if got, want := checksums(), md5Hex("b")+" "+sha+"  b.txt\n"; !strings.Contains(got, want) {
+		t.Errorf("--sha256 printed:\n%s\nwant the line %q", got, want)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+type configCmd struct{}
+
+// printConfig prints the value of every flag as resolved from the command
+// line, the environment and the defaults, with secrets redacted.
+func printConfig(ctx *kong.Context) error {
+	config := map[string]interface{}{}
+	for _, flag := range ctx.Flags() {
+		if flag.Name == "help" {
+			continue
+		}
+		config[flag.Name] = redactValue(flag.Name, flag.Target.Interface())
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, string(data))
+	return nil
+}
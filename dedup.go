@@ -0,0 +1,63 @@
+package main
+
+import "path/filepath"
+
+// splitDuplicates separates the entries sharing the MD5 of an earlier entry,
+// so identical content is only downloaded once.
+func splitDuplicates(needed []fileEntry) (unique, duplicates []fileEntry) {
+	seen := map[string]bool{}
+	for _, dl := range needed {
+		if seen[dl.MD5] {
+			duplicates = append(duplicates, dl)
+			continue
+		}
+		seen[dl.MD5] = true
+		unique = append(unique, dl)
+	}
+	return unique, duplicates
+}
+
+// installDuplicates copies the written files to the duplicates sharing their
+// MD5, verifying each copy, and downloads the duplicates whose content
+// wasn't written through fetch, like the other downloads. It returns the
+// entries written.
+func (list *fileListYaml) installDuplicates(rootPath string, duplicates, written []fileEntry, fetch func(fileEntry) bool, report *runReport) []fileEntry {
+	sources := map[string]string{}
+	for _, dl := range written {
+		sources[dl.MD5] = dl.Name
+	}
+	res := []fileEntry{}
+	for _, dl := range duplicates {
+		source, ok := sources[dl.MD5]
+		if !ok {
+			if fetch(dl) {
+				res = append(res, dl)
+			}
+			continue
+		}
+		reporter.Logf("COPY %s to %s", source, dl.Name)
+		data, err := readStorageFile(filepath.Join(rootPath, source))
+		if err == nil {
+			err = checkMD5(data, dl.MD5)
+		}
+		fullPath := filepath.Join(rootPath, dl.Name)
+		if err == nil {
+			err = list.installFile(fullPath, data)
+		}
+		if err == nil {
+			var actualMD5 string
+			if actualMD5, _, err = storage.Hash(fullPath); err == nil && actualMD5 != dl.MD5 {
+				err = &hashMismatchError{Expected: dl.MD5, Actual: actualMD5}
+			}
+		}
+		reporter.FileDone(dl.Name, err)
+		if err != nil {
+			reporter.Logf("ERROR: %v", err)
+			report.addFailure(dl.Name, failFilesystem, err)
+			continue
+		}
+		report.addDownloaded(dl.Name)
+		res = append(res, dl)
+	}
+	return res
+}
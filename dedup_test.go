@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicatesDownloadedOnce(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "shared", "sub/copy.txt": "shared", "other.txt": "other"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount("/files/a.txt") + srv.requestCount("/files/sub/copy.txt"); n != 1 {
+		t.Errorf("the shared content was requested %d times, want once", n)
+	}
+	for name, content := range map[string]string{"a.txt": "shared", "sub/copy.txt": "shared", "other.txt": "other"} {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	if len(report.Downloaded) != 3 || len(report.Failed) != 0 {
+		t.Errorf("downloaded %q, failed %+v", report.Downloaded, report.Failed)
+	}
+}
+
+func TestDuplicateDownloadedWhenSourceFails(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "shared", "b.txt": "shared"})
+	// the first copy is missing on the server
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "a.txt") })
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, rootPath, "b.txt") != "shared" || srv.requestCount("/files/b.txt") != 1 {
+		t.Error("b.txt was not downloaded itself")
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Name != "a.txt" {
+		t.Errorf("failed = %+v, want only a.txt", report.Failed)
+	}
+}
+
+func TestDuplicateDeferredWithSource(t *testing.T) {
+	shared := strings.Repeat("s", 100)
+	srv := newTestServer(t, map[string]string{"a.txt": shared, "b.txt": shared})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--max-total-bytes", "50")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount("/files/a.txt") + srv.requestCount("/files/b.txt"); n != 0 {
+		t.Errorf("%d files requested beyond --max-total-bytes", n)
+	}
+	if len(report.Deferred) != 2 || len(report.Downloaded) != 0 {
+		t.Errorf("deferred %q, downloaded %q, want both deferred", report.Deferred, report.Downloaded)
+	}
+}
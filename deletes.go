@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// expandDeletes returns the delete entries with glob entries replaced by an
+// entry for each matching path under rootPath.
+func (list *fileListYaml) expandDeletes(rootPath string, report *runReport) []fileEntry {
+	res := []fileEntry{}
+	for _, del := range list.Deletes {
+		if !del.Glob {
+			res = append(res, del)
+			continue
+		}
+		matches, err := globUnderRoot(rootPath, del.Name, list.excludes)
+		if err != nil {
+			fmt.Fprintln(stdout, "- Delete pattern failed:", err)
+			report.addFailure(del.Name, failFilesystem, err)
+			continue
+		}
+		for _, name := range matches {
+			res = append(res, fileEntry{Name: name, Glob: true})
+		}
+	}
+	return filterExcluded(res, list.excludes)
+}
+
+// globUnderRoot returns the slash separated paths below rootPath matching
+// pattern. Matching directories are returned without their contents, unless
+// they contain paths matching excludes, in which case their contents are
+// returned instead, so those paths can be filtered out.
+func globUnderRoot(rootPath, pattern string, excludes []string) ([]string, error) {
+	if err := validateDeletePattern(pattern); err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	err := walkStorage(rootPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchesOrParent(pattern, rel) {
+			return nil
+		}
+		if d.IsDir() && containsExcluded(rootPath, rel, excludes) {
+			return nil
+		}
+		matches = append(matches, rel)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// matchesOrParent reports whether pattern matches name or one of its parent
+// folders.
+func matchesOrParent(pattern, name string) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// containsExcluded reports whether the folder rel below rootPath is, or
+// contains, a path matching excludes.
+func containsExcluded(rootPath, rel string, excludes []string) bool {
+	if len(excludes) == 0 {
+		return false
+	}
+	errFound := errors.New("found")
+	err := walkStorage(filepath.Join(rootPath, filepath.FromSlash(rel)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if name, err := filepath.Rel(rootPath, p); err == nil && isExcluded(filepath.ToSlash(name), excludes) {
+			return errFound
+		}
+		return nil
+	})
+	return err == errFound
+}
+
+func validateDeletePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid delete pattern %q: %w", pattern, err)
+	}
+	clean := path.Clean(pattern)
+	first, _, _ := strings.Cut(clean, "/")
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || onlyWildcards(first) {
+		return fmt.Errorf("refusing delete pattern %q outside of or matching the whole root", pattern)
+	}
+	return nil
+}
+
+// onlyWildcards reports whether the pattern segment has no literal characters
+// besides dots, so that it matches any top-level entry, or any hidden one.
+func onlyWildcards(segment string) bool {
+	for i := 0; i < len(segment); i++ {
+		switch segment[i] {
+		case '*', '?', '.':
+		case '[':
+			// skip the character class, which path.Match already validated
+			for i++; i < len(segment) && segment[i] != ']'; i++ {
+				if segment[i] == '\\' {
+					i++
+				}
+			}
+		case '\\':
+			if i+1 < len(segment) && segment[i+1] != '.' {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// keepModified reports whether the file of del should be kept because the
+// entry has an MD5 that the local file doesn't match, meaning it was
+// modified by the user or already updated.
+func keepModified(rootPath string, del fileEntry) bool {
+	if del.MD5 == "" || del.Glob {
+		return false
+	}
+	actualMD5, _, err := storage.Hash(filepath.Join(rootPath, del.Name))
+	if err != nil {
+		fmt.Fprintln(stdout, "WARNING: keeping", del.Name+":", err)
+		return true
+	}
+	if actualMD5 != del.MD5 {
+		fmt.Fprintln(stdout, "WARNING: keeping", del.Name+", it has MD5", actualMD5, "instead of", del.MD5)
+		return true
+	}
+	return false
+}
+
+// verifyDeleted warns about files reported as deleted that still exist, as
+// can happen on some network and FUSE filesystems.
+func verifyDeleted(rootPath string, report *runReport) {
+	for _, name := range report.Deleted {
+		if storage.Exists(filepath.Join(rootPath, name)) {
+			fmt.Fprintln(stdout, "WARNING: deleted file still exists:", name)
+			report.addFailure(name, failFilesystem, fmt.Errorf("still exists after being deleted"))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobDeleteRemovesSubtree(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"eqgame.exe": "game"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "uifiles/oldskin", Glob: true}, {Name: "logs/*.bak", Glob: true}}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{
+		"eqgame.exe":                 "game",
+		"uifiles/oldskin/a.xml":      "a",
+		"uifiles/oldskin/tga/b.tga":  "b",
+		"uifiles/default/c.xml":      "c",
+		"logs/old.bak":               "old",
+		"logs/eqlog.txt":             "log",
+		"logs/nested/deeper.bak.txt": "deeper",
+	})
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	for name, want := range map[string]string{
+		"uifiles/oldskin/a.xml":      "<missing>",
+		"uifiles/oldskin/tga/b.tga":  "<missing>",
+		"logs/old.bak":               "<missing>",
+		"uifiles/default/c.xml":      "c",
+		"logs/eqlog.txt":             "log",
+		"logs/nested/deeper.bak.txt": "deeper",
+	} {
+		if got := readTestFile(t, rootPath, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if storage.Exists(filepath.Join(rootPath, "uifiles", "oldskin")) {
+		t.Error("uifiles/oldskin still exists")
+	}
+}
+
+func TestValidateDeletePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"uifiles/oldskin", true},
+		{"maps/*.old", true},
+		{"*", false},
+		{".", false},
+		{"./", false},
+		{"..", false},
+		{"../other/*", false},
+		{"uifiles/../../*", false},
+		{"/etc/*", false},
+		{"[", false},
+		{"**", false},
+		{"?*", false},
+		{"[a-z]*", false},
+		{"[^x]*", false},
+		{".*", false},
+		{"*/..", false},
+		{"*/old.txt", false},
+		{"\\*", true},
+		{"*.bak", true},
+		{"old[0-9].txt", true},
+	}
+	for _, tt := range tests {
+		if err := validateDeletePattern(tt.pattern); (err == nil) != tt.ok {
+			t.Errorf("validateDeletePattern(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
+
+func TestLargeDeleteListNeedsInterlock(t *testing.T) {
+	tests := []struct {
+		deletes int
+		extra   []string
+		ok      bool
+	}{
+		{3, nil, true},
+		{4, nil, false},
+		{4, []string{"--yes-delete-anything"}, true},
+	}
+	for _, tt := range tests {
+		srv := newTestServer(t, map[string]string{"keep.txt": "keep"})
+		rootPath := t.TempDir()
+		srv.update(func(list *fileListYaml, _ map[string][]byte) {
+			for i := 0; i < tt.deletes; i++ {
+				name := fmt.Sprintf("old%d.txt", i)
+				writeTestFiles(t, rootPath, map[string]string{name: "old"})
+				list.Deletes = append(list.Deletes, fileEntry{Name: name})
+			}
+		})
+		setupTest(t, srv.patchArgs(rootPath, append([]string{"--delete-threshold", "3"}, tt.extra...)...)...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if (err == nil) != tt.ok {
+			t.Fatalf("%d deletes with %q: patchRoot() = %v, want ok %v", tt.deletes, tt.extra, err, tt.ok)
+		}
+		if !tt.ok {
+			// refused before touching anything
+			if readTestFile(t, rootPath, "old0.txt") != "old" || readTestFile(t, rootPath, "keep.txt") != "<missing>" {
+				t.Errorf("%d deletes with %q changed the install", tt.deletes, tt.extra)
+			}
+			continue
+		}
+		if len(report.Deleted) != tt.deletes {
+			t.Errorf("%d deletes with %q deleted %d files", tt.deletes, tt.extra, len(report.Deleted))
+		}
+	}
+}
+
+// stickyStorage is the local filesystem, except that names in keep survive
+// being removed, as happens on some network filesystems.
+type stickyStorage struct {
+	osStorage
+	keep map[string]bool
+}
+
+func (s stickyStorage) Remove(fileName string) error {
+	if s.keep[filepath.Base(fileName)] {
+		return nil
+	}
+	return s.osStorage.Remove(fileName)
+}
+
+func TestVerifyDeletesWarnsAboutRemainingFiles(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "gone.txt"}, {Name: "stuck.txt"}}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"gone.txt": "x", "stuck.txt": "x"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--verify-deletes")...)
+	storage = stickyStorage{keep: map[string]bool{"stuck.txt": true}}
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "WARNING: deleted file still exists: stuck.txt") {
+		t.Errorf("no warning about stuck.txt:\n%s", out)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Name != "stuck.txt" || report.Failed[0].Category != failFilesystem {
+		t.Errorf("failed = %+v, want only stuck.txt", report.Failed)
+	}
+	if readTestFile(t, rootPath, "gone.txt") != "<missing>" {
+		t.Error("gone.txt was not deleted")
+	}
+}
+
+func TestConditionalDeletes(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{
+			{Name: "unmodified.txt", MD5: md5Hex("old")},
+			{Name: "modified.txt", MD5: md5Hex("old")},
+			{Name: "unconditional.txt"},
+		}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"unmodified.txt": "old", "modified.txt": "changed by the user", "unconditional.txt": "x"})
+	out := setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"unmodified.txt": "<missing>", "modified.txt": "changed by the user", "unconditional.txt": "<missing>"}
+	for name, content := range want {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	if len(report.Deleted) != 2 {
+		t.Errorf("deleted = %q, want 2 files", report.Deleted)
+	}
+	if !strings.Contains(out.String(), "WARNING: keeping modified.txt, it has MD5 "+md5Hex("changed by the user")) {
+		t.Errorf("kept file not reported:\n%s", out)
+	}
+}
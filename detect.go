@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	expansions = []string{"original", "kunark"}
+	clients    = []string{"rof"}
+)
+
+type installState struct {
+	Expansion string
+	Client    string
+
+	// filelist version fully applied by the last run, for --assume-root-clean
+	Version string `yaml:",omitempty"`
+}
+
+// installStatePath returns where the install state of rootPath is kept in
+// the settings dir, which is written after a successful patch so the
+// expansion and client can be detected on later runs.
+func installStatePath(rootPath string) string {
+	abs, err := filepath.Abs(rootPath)
+	if err != nil {
+		abs = rootPath
+	}
+	return filepath.Join(getSettingsRoot(), "install_"+md5OfData([]byte(abs))[:8]+".yml")
+}
+
+func readInstallState(rootPath string) (installState, error) {
+	var state installState
+	fileName := installStatePath(rootPath)
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return state, nil
+}
+
+// detectInstall fills in expansion and client values not given on the
+// command line by inspecting rootPath.
+func detectInstall(rootPath string, expansion, client string) (string, string, error) {
+	if expansion != "" && client != "" {
+		return expansion, client, nil
+	}
+
+	state, err := readInstallState(rootPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	if client == "" {
+		client = state.Client
+	}
+	if client == "" && fileOrDirExists(filepath.Join(rootPath, "eqgame.exe")) {
+		// rof2 is the only supported client
+		client = "rof"
+	}
+	if client == "" {
+		return "", "", fmt.Errorf("could not detect the client of %s, no eqgame.exe found. Please pass --client (one of %s)", rootPath, strings.Join(clients, ", "))
+	}
+
+	if expansion == "" {
+		expansion = state.Expansion
+	}
+	if expansion == "" {
+		var err error
+		if expansion, err = expansionOfFolder(filepath.Base(rootPath)); err != nil {
+			return "", "", fmt.Errorf("could not detect the expansion of %s, %v. Please pass --expansion (one of %s)", rootPath, err, strings.Join(expansions, ", "))
+		}
+	}
+	return expansion, client, nil
+}
+
+// expansionOfFolder returns the expansion of an install folder named after
+// it, such as fvp-original. Names only containing an expansion name, such as
+// fvp-original-backup, are refused rather than guessed at.
+func expansionOfFolder(folderName string) (string, error) {
+	folderName = strings.ToLower(folderName)
+	mentioned := []string{}
+	for _, e := range expansions {
+		if folderName == e || folderName == "fvp-"+e {
+			return e, nil
+		}
+		if strings.Contains(folderName, e) {
+			mentioned = append(mentioned, e)
+		}
+	}
+	if len(mentioned) > 0 {
+		return "", fmt.Errorf("the folder name %q mentions %s, but isn't named fvp-<expansion>", folderName, strings.Join(mentioned, " and "))
+	}
+	return "", fmt.Errorf("the folder name %q is not fvp-<expansion>", folderName)
+}
+
+func validateInstallArgs(expansion, client string) error {
+	if !contains(expansions, expansion) {
+		return fmt.Errorf("--expansion must be one of %s, got %q", strings.Join(expansions, ", "), expansion)
+	}
+	if !contains(clients, client) {
+		return fmt.Errorf("--client must be one of %s, got %q", strings.Join(clients, ", "), client)
+	}
+	return nil
+}
+
+func writeInstallState(rootPath string, state installState) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFile(installStatePath(rootPath), data)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFixtureInstall creates folder name in a temp dir with files in it.
+func newFixtureInstall(t *testing.T, name string, files map[string]string) string {
+	t.Helper()
+	rootPath := filepath.Join(t.TempDir(), name)
+	if err := os.Mkdir(rootPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, rootPath, files)
+	return rootPath
+}
+
+func TestDetectInstall(t *testing.T) {
+	tests := []struct {
+		folder              string
+		files               map[string]string
+		state               *installState
+		expansion, client   string
+		wantExp, wantClient string
+		ok                  bool
+	}{
+		{"fvp-Kunark", map[string]string{"eqgame.exe": ""}, nil, "", "", "kunark", "rof", true},
+		{"fvp-original", map[string]string{"eqgame.exe": ""}, nil, "", "", "original", "rof", true},
+		{"original", map[string]string{"eqgame.exe": ""}, nil, "", "", "original", "rof", true},
+		// flags override detection
+		{"fvp-kunark", map[string]string{"eqgame.exe": ""}, nil, "original", "", "original", "rof", true},
+		// the state of the last run wins over the folder name
+		{"fvp-original", nil, &installState{Expansion: "kunark", Client: "rof"}, "", "", "kunark", "rof", true},
+		{"fvp-original", nil, nil, "", "", "", "", false},
+		{"everquest", map[string]string{"eqgame.exe": ""}, nil, "", "", "", "", false},
+		// names merely containing an expansion are not guessed at
+		{"fvp-original-backup", map[string]string{"eqgame.exe": ""}, nil, "", "", "", "", false},
+		{"kunark-on-original", map[string]string{"eqgame.exe": ""}, nil, "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		setupTest(t)
+		rootPath := newFixtureInstall(t, tt.folder, tt.files)
+		if tt.state != nil {
+			if err := writeInstallState(rootPath, *tt.state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expansion, client, err := detectInstall(rootPath, tt.expansion, tt.client)
+		if (err == nil) != tt.ok || expansion != tt.wantExp || client != tt.wantClient {
+			t.Errorf("detectInstall(%s with %d files, %q, %q) = %q, %q, %v, want %q, %q, ok %v",
+				tt.folder, len(tt.files), tt.expansion, tt.client, expansion, client, err, tt.wantExp, tt.wantClient, tt.ok)
+		}
+	}
+}
+
+func TestInstallStateKeptInSettingsDir(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"eqgame.exe": "game"})
+	rootPath := newFixtureInstall(t, "everquest", nil)
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(rootPath); len(entries) != 1 {
+		t.Errorf("the root holds %d entries, want only eqgame.exe", len(entries))
+	}
+	state, err := readInstallState(rootPath)
+	if err != nil || state.Expansion == "" || state.Client == "" {
+		t.Errorf("install state = %+v, %v", state, err)
+	}
+	if expansion, _, err := detectInstall(rootPath, "", ""); err != nil || expansion != state.Expansion {
+		t.Errorf("detected %q, %v, want the expansion of the last run", expansion, err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// number of most recent run log entries included in the diagnostics
+const diagnoseRunLogLines = 20
+
+type diagnostics struct {
+	Time      time.Time
+	Reason    string `yaml:",omitempty"`
+	Tool      string
+	GoVersion string
+	OS        string
+	Arch      string
+	Settings  string
+	Config    map[string]interface{}
+	LastRuns  []string
+}
+
+// writeDiagnostics writes a bundle describing the environment, the redacted
+// configuration and the last runs to the settings dir, returning its path.
+// It never uses the network.
+func writeDiagnostics(reason string) (string, error) {
+	d := diagnostics{
+		Time:      time.Now(),
+		Reason:    reason,
+		Tool:      toolVersion(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Settings:  getSettingsRoot(),
+		Config:    redactedConfig(),
+		LastRuns:  lastRunLogLines(filepath.Join(getSettingsRoot(), runLogName), diagnoseRunLogLines),
+	}
+	data, err := yaml.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	fileName := filepath.Join(getSettingsRoot(), "diagnostics-"+d.Time.Format("20060102-150405")+".yml")
+	return fileName, writeFile(fileName, data)
+}
+
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Path + " " + info.Main.Version
+}
+
+// redactedConfig returns the parsed flags with values of secret-looking keys
+// and passwords in URLs removed.
+func redactedConfig() map[string]interface{} {
+	config := map[string]interface{}{}
+	data, err := yaml.Marshal(&arg)
+	if err != nil {
+		return config
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config
+	}
+	for key, value := range config {
+		config[key] = redactValue(key, value)
+	}
+	return config
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, secret := range []string{"password", "token", "auth", "secret"} {
+		if strings.Contains(lower, secret) {
+			if value == "" || value == nil {
+				return value
+			}
+			return "REDACTED"
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return redactURL(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(key, v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = redactValue(k, v[k])
+		}
+	}
+	return value
+}
+
+// redactURL removes passwords from s if it is a URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
+
+// urlPassword matches the password of URLs in text.
+var urlPassword = regexp.MustCompile(`(\w+://[^/:@\s"]*:)[^/@\s"]*@`)
+
+// redactURLsIn removes passwords from the URLs anywhere in s, such as in
+// the errors of the run log.
+func redactURLsIn(s string) string {
+	return urlPassword.ReplaceAllString(s, "${1}REDACTED@")
+}
+
+func lastRunLogLines(fileName string, n int) []string {
+	lines := []string{}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, runLogMaxSize)
+	for scanner.Scan() {
+		lines = append(lines, redactURLsIn(scanner.Text()))
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// crashOnce makes sure only the first of several panicking goroutines
+// writes diagnostics.
+var crashOnce sync.Once
+
+// writeCrashDiagnostics is deferred in main and in every goroutine to write
+// diagnostics if the tool panics, before re-panicking, as recover only sees
+// panics of its own goroutine.
+func writeCrashDiagnostics() {
+	if r := recover(); r != nil {
+		crashOnce.Do(func() {
+			if fileName, err := writeDiagnostics(fmt.Sprintf("panic: %v\n%s", r, debug.Stack())); err == nil {
+				fmt.Fprintln(os.Stderr, "fvpatcher crashed, please attach", fileName, "to your bug report")
+			}
+		})
+		panic(r)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func (list *fileListYaml) dryRunDownloads(needed []fileEntry, report *runReport) {
+	for _, dl := range needed {
+		fmt.Fprintf(stdout, "Would download %s (%s)\n", dl.Name, describeSize(dl))
+		if !arg.CheckServer {
+			continue
+		}
+		size := dl.Size
+		if dl.Compression != "" {
+			// the server has the compressed size
+			size = 0
+		}
+		if err := checkServerFile(list.downloadURL(dl), size); err != nil {
+			fmt.Fprintln(stdout, "- ERROR:", err)
+			if _, ok := err.(*serverDriftError); ok {
+				report.addFailure(dl.Name, failServerDrift, err)
+			} else {
+				report.addFailure(dl.Name, failNetwork, err)
+			}
+		}
+	}
+	fmt.Fprintf(stdout, "- %d files would be downloaded\n", len(needed))
+}
+
+// describeSize formats the Size of dl, which is 0 if not given unless the
+// file is empty.
+func describeSize(dl fileEntry) string {
+	if dl.Size == 0 && dl.MD5 != emptyMD5 {
+		return "size unknown"
+	}
+	return formatBytes(int64(dl.Size))
+}
+
+type serverDriftError struct {
+	msg string
+}
+
+func (e *serverDriftError) Error() string { return e.msg }
+
+// checkServerFile confirms with a HEAD request that the server has url, with
+// a Content-Length of size when both are known.
+func checkServerFile(url string, size uint) error {
+	response, err := newHTTPClient().Head(url)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &serverDriftError{fmt.Sprintf("HEAD %s: %s", url, response.Status)}
+	}
+	if size > 0 && response.ContentLength >= 0 && uint64(response.ContentLength) != uint64(size) {
+		return &serverDriftError{fmt.Sprintf("HEAD %s: server has %d bytes, manifest says %d", url, response.ContentLength, size)}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunReportsServerDrift(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"ok.txt": "ok", "resized.txt": "resized", "gone.txt": "gone"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) {
+		files["resized.txt"] = []byte("resized, but the filelist wasn't updated")
+		delete(files, "gone.txt")
+	})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--dry-run", "--check-server")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]failureCategory{}
+	for _, f := range report.Failed {
+		got[f.Name] = f.Category
+	}
+	if len(got) != 2 || got["resized.txt"] != failServerDrift || got["gone.txt"] != failServerDrift {
+		t.Errorf("failed = %+v, want resized.txt and gone.txt as server mismatches", report.Failed)
+	}
+	if !strings.Contains(out.String(), "server has 40 bytes, manifest says 7") {
+		t.Errorf("size mismatch not reported:\n%s", out)
+	}
+	// only the HEAD request
+	if srv.requestCount("/files/ok.txt") != 1 || readTestFile(t, rootPath, "ok.txt") != "<missing>" {
+		t.Error("ok.txt was downloaded in a dry run")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dumpManifest prints the filelist in fileName in a normalized form, with
+// lowercase hashes and the entries sorted by name, for diffing filelists.
+func dumpManifest(fileName string) error {
+	list, err := readFileList(fileName)
+	if err != nil {
+		return err
+	}
+	for _, entries := range [][]fileEntry{list.Deletes, list.Downloads} {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	data, err := yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(data)
+	return err
+}
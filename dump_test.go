@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpManifestIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	// hand edited, out of order and with an uppercase hash
+	handEdited := `version:   "3"
+downloadprefix: https://files.example.com/
+deletes:
+  - name: z_old.txt
+  - name: a_old.txt
+downloads:
+    - name: maps/zone.eqg
+      md5: ` + strings.ToUpper(md5Hex("zone")) + `
+      size: 4
+    - {name: eqgame.exe, md5: ` + md5Hex("game") + `, size: 4}
+`
+	// dump returns the dump of a filelist with content
+	dump := func(name, content string) string {
+		t.Helper()
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out := setupTest(t)
+		if err := dumpManifest(fileName); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	first := dump("filelist.yml", handEdited)
+	if second := dump("dumped.yml", first); second != first {
+		t.Errorf("dumping the dump changed it:\n%s\nto:\n%s", first, second)
+	}
+	if strings.Index(first, "a_old.txt") > strings.Index(first, "z_old.txt") || strings.Index(first, "eqgame.exe") > strings.Index(first, "maps/zone.eqg") {
+		t.Errorf("entries are not sorted:\n%s", first)
+	}
+	if !strings.Contains(first, md5Hex("zone")) {
+		t.Errorf("hash is not lowercase:\n%s", first)
+	}
+
+	// the order of the entries doesn't matter
+	reordered := strings.Replace(handEdited, "  - name: z_old.txt\n  - name: a_old.txt\n", "  - name: a_old.txt\n  - name: z_old.txt\n", 1)
+	if got := dump("reordered.yml", reordered); got != first {
+		t.Errorf("reordered filelist dumped as:\n%s\nwant:\n%s", got, first)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// failedListPath returns the file in the settings dir listing the entries
+// that failed in the last run on rootPath.
+func failedListPath(rootPath string) string {
+	abs, err := filepath.Abs(rootPath)
+	if err != nil {
+		abs = rootPath
+	}
+	return filepath.Join(getSettingsRoot(), "failed_"+md5OfData([]byte(abs))[:8]+".txt")
+}
+
+// writeFailedList saves the names of the failed entries of report, and of the
+// downloads cut off or not started by an interrupt, for --retry-failed. The
+// list is removed if nothing failed.
+func writeFailedList(rootPath string, report *runReport) error {
+	fileName := failedListPath(rootPath)
+	if len(report.Failed) == 0 && len(report.InFlight) == 0 && len(report.Pending) == 0 {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var sb strings.Builder
+	for _, f := range report.Failed {
+		sb.WriteString(f.Name + "\n")
+	}
+	for _, name := range append(report.InFlight, report.Pending...) {
+		sb.WriteString(name + "\n")
+	}
+	return writeFile(fileName, []byte(sb.String()))
+}
+
+// readFailedList returns the names of the entries that failed in the last
+// run on rootPath.
+func readFailedList(rootPath string) (map[string]bool, error) {
+	data, err := os.ReadFile(failedListPath(rootPath))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no failed files recorded for %s, nothing to retry", rootPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			names[line] = true
+		}
+	}
+	return names, nil
+}
+
+func onlyNamed(entries []fileEntry, names map[string]bool) []fileEntry {
+	res := []fileEntry{}
+	for _, e := range entries {
+		if names[e.Name] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryFailed(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/b.txt" {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readFailedList(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || !names["b.txt"] {
+		t.Fatalf("failed list = %v, want only b.txt", names)
+	}
+
+	// the next run retries only b.txt, ignoring other changes
+	srv.Config.Handler = handler
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "modified", "old.txt": "old"})
+	settings := settingsRoot
+	out := setupTest(t, srv.patchArgs(rootPath, "--retry-failed")...)
+	settingsRoot = settings
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Retrying 1 failed files") {
+		t.Errorf("retry not reported:\n%s", out)
+	}
+	want := map[string]string{"a.txt": "modified", "b.txt": "b", "old.txt": "old"}
+	for name, content := range want {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	// and the list is cleared once they succeeded
+	if _, err := readFailedList(rootPath); err == nil {
+		t.Error("failed list still exists after a successful retry")
+	}
+	if _, err := patchRoot(rootPath, time.Time{}); err == nil {
+		t.Error("--retry-failed without failed files succeeded")
+	}
+}
+
+func TestFailedListIncludesPending(t *testing.T) {
+	setupTest(t, "patch", t.TempDir())
+	rootPath := t.TempDir()
+	report := newRunReport(rootPath, "1")
+	report.addFailure("failed.txt", failNetwork, &httpStatusError{"GET", "http://example.com/failed.txt", 503, "503 Service Unavailable"})
+	report.addInFlight("cut-off.txt")
+	report.addPending("not-started.txt")
+	if err := writeFailedList(rootPath, report); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readFailedList(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 || !names["failed.txt"] || !names["cut-off.txt"] || !names["not-started.txt"] {
+		t.Errorf("failed list = %v", names)
+	}
+}
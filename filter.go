@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var entryDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"20060102",
+}
+
+func parseEntryDate(s string) (time.Time, error) {
+	for _, layout := range entryDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+// filterSince returns the entries dated on or after since. Entries with a
+// missing or unparseable date are kept only if includeUndated is set.
+func filterSince(entries []fileEntry, since time.Time, includeUndated bool) []fileEntry {
+	res := []fileEntry{}
+	for _, e := range entries {
+		date, err := parseEntryDate(e.Date)
+		if err != nil {
+			if includeUndated {
+				res = append(res, e)
+			} else if arg.Verbose {
+				fmt.Fprintln(stdout, "Skipping", e.Name+":", err)
+			}
+			continue
+		}
+		if date.Before(since) {
+			if arg.Verbose {
+				fmt.Fprintln(stdout, "Skipping", e.Name, "dated", e.Date)
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+var excludePatterns []string
+
+// name of the file in the root with exclude patterns of the user
+const ignoreFileName = ".fvpatcherignore"
+
+// loadExcludeFile reads newline separated patterns from fileName, skipping
+// blank lines and lines starting with #. Leading and trailing slashes are
+// ignored, as patterns always match from the root and match directories
+// including their contents.
+func loadExcludeFile(fileName string) ([]string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	patterns := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			return nil, fmt.Errorf("%s: negated pattern %q is not supported", fileName, line)
+		}
+		line = strings.Trim(line, "/")
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q", fileName, line)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// rootExcludePatterns returns the exclude patterns from the command line
+// together with those of the ignore file in rootPath, if any.
+func rootExcludePatterns(rootPath string) ([]string, error) {
+	fileName := filepath.Join(rootPath, ignoreFileName)
+	if !fileOrDirExists(fileName) {
+		return excludePatterns, nil
+	}
+	patterns, err := loadExcludeFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, excludePatterns...), patterns...), nil
+}
+
+// isExcluded reports whether name, or one of its parent folders, matches
+// one of patterns.
+func isExcluded(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func filterExcluded(entries []fileEntry, patterns []string) []fileEntry {
+	if len(patterns) == 0 {
+		return entries
+	}
+	res := []fileEntry{}
+	for _, e := range entries {
+		if isExcluded(e.Name, patterns) {
+			if arg.Verbose {
+				fmt.Fprintln(stdout, "Excluded", e.Name)
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterSince(t *testing.T) {
+	entries := []fileEntry{
+		{Name: "old.txt", Date: "2022-12-31"},
+		{Name: "same-day.txt", Date: "2023-01-15 00:00:00"},
+		{Name: "new.txt", Date: "2023-02-01T10:00:00Z"},
+		{Name: "compact.txt", Date: "20230301"},
+		{Name: "undated.txt"},
+		{Name: "garbled.txt", Date: "last tuesday"},
+	}
+	since := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		includeUndated bool
+		want           []string
+	}{
+		{false, []string{"same-day.txt", "new.txt", "compact.txt"}},
+		{true, []string{"same-day.txt", "new.txt", "compact.txt", "undated.txt", "garbled.txt"}},
+	}
+	setupTest(t)
+	for _, tt := range tests {
+		got := []string{}
+		for _, e := range filterSince(entries, since, tt.includeUndated) {
+			got = append(got, e.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filterSince(includeUndated %v) = %q, want %q", tt.includeUndated, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeFromProtectsFiles(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"eqclient.ini": "defaults", "maps/custom.eqg": "official", "spells.txt": "spells"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "uifiles/oldskin", Glob: true}}
+	})
+	rootPath := t.TempDir()
+	local := map[string]string{
+		"eqclient.ini":             "my settings",
+		"maps/custom.eqg":          "my map",
+		"spells.txt":               "old spells",
+		"uifiles/oldskin/a.xml":    "a",
+		"uifiles/oldskin/mine.xml": "mine",
+	}
+	writeTestFiles(t, rootPath, local)
+	excludeFile := filepath.Join(t.TempDir(), "excludes.txt")
+	writeTestFiles(t, filepath.Dir(excludeFile), map[string]string{"excludes.txt": "# my files\n\n*.ini\n  /uifiles/oldskin/mine.xml/  \n"})
+	setupTest(t, srv.patchArgs(rootPath, "--exclude-from", excludeFile, "--exclude", "maps/custom.eqg")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	for name, want := range map[string]string{
+		"eqclient.ini":             local["eqclient.ini"],
+		"maps/custom.eqg":          local["maps/custom.eqg"],
+		"uifiles/oldskin/mine.xml": local["uifiles/oldskin/mine.xml"],
+		"spells.txt":               "spells",
+		"uifiles/oldskin/a.xml":    "<missing>",
+	} {
+		if got := readTestFile(t, rootPath, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadExcludeFile(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+		ok      bool
+	}{
+		{"# comment\n\n*.ini\r\n/uiskins/Mine/\n", []string{"*.ini", "uiskins/Mine"}, true},
+		{"", []string{}, true},
+		{"*.ini\n!eqclient.ini\n", nil, false},
+		{"[\n", nil, false},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(t.TempDir(), "excludes.txt")
+		writeTestFiles(t, filepath.Dir(fileName), map[string]string{"excludes.txt": tt.content})
+		got, err := loadExcludeFile(fileName)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("loadExcludeFile(%q) = %q, %v, want %q, ok %v", tt.content, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIgnoreFileProtectsFiles(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"eqclient.ini": "defaults", "spells.txt": "spells"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "uiskins/Mine/skin.xml"}, {Name: "uiskins", Glob: true}, {Name: "old.txt"}}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{
+		ignoreFileName:          "# my own ui skin\nuiskins/Mine\n*.ini\n",
+		"eqclient.ini":          "my settings",
+		"uiskins/Mine/skin.xml": "mine",
+		"uiskins/Old/skin.xml":  "old skin",
+		"old.txt":               "old",
+		"spells.txt":            "old spells",
+	})
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	for name, want := range map[string]string{
+		"eqclient.ini":          "my settings",
+		"uiskins/Mine/skin.xml": "mine",
+		"uiskins/Old/skin.xml":  "<missing>",
+		"old.txt":               "<missing>",
+		"spells.txt":            "spells",
+	} {
+		if got := readTestFile(t, rootPath, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -4,5 +4,9 @@ go 1.19
 
 require (
 	github.com/alecthomas/kong v0.7.1
+	github.com/klauspost/compress v1.17.0
+	golang.org/x/crypto v0.17.0
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// files smaller than this are hashed by streaming even with --mmap, as the
+// mapping overhead outweighs the saved read calls
+const mmapMinSize = 4 << 20
+
+// how often progress is reported while hashing local files, if that takes
+// longer
+var hashProgressInterval = time.Second
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// MD5 of an empty file, which is created without downloading anything
+const emptyMD5 = "d41d8cd98f00b204e9800998ecf8427e"
+
+// hashOpenFiles bounds the files held open by md5OfFile with --max-open-files,
+// independent of --hash-workers
+var hashOpenFiles chan struct{}
+
+// hashMismatchError is returned when data does not have the MD5 the manifest
+// expects.
+type hashMismatchError struct {
+	Expected string
+	Actual   string
+
+	// ErrorPage is set if the data looks like an HTML page, as sent by
+	// misconfigured servers instead of a missing file
+	ErrorPage bool
+}
+
+func (e *hashMismatchError) Error() string {
+	if e.ErrorPage {
+		return fmt.Sprintf("server returned an error page instead of the file (got MD5 %s, expected %s)", e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("got MD5 %s, expected %s", e.Actual, e.Expected)
+}
+
+// checkMD5 returns a *hashMismatchError if data does not have the MD5 expected.
+func checkMD5(data []byte, expected string) error {
+	if actual := md5OfData(data); actual != expected {
+		return &hashMismatchError{Expected: expected, Actual: actual, ErrorPage: looksLikeHTML(data)}
+	}
+	return nil
+}
+
+func looksLikeHTML(data []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(data), "text/html")
+}
+
+type localHash struct {
+	exists bool
+	md5    string
+	err    error
+}
+
+// hashLocalFiles hashes the local copies of entries using --hash-workers
+// parallel workers. The result is indexed like entries.
+func hashLocalFiles(rootPath string, entries []fileEntry) []localHash {
+	workers := arg.HashWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	res := make([]localHash, len(entries))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	var done, hashedBytes atomic.Int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer writeCrashDiagnostics()
+			for idx := range queue {
+				fullPath := filepath.Join(rootPath, entries[idx].Name)
+				if !storage.Exists(fullPath) {
+					done.Add(1)
+					continue
+				}
+				res[idx].exists = true
+				var size int64
+				res[idx].md5, size, res[idx].err = storage.Hash(fullPath)
+				hashedBytes.Add(size)
+				done.Add(1)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		defer writeCrashDiagnostics()
+		ticker := time.NewTicker(hashProgressInterval)
+		defer ticker.Stop()
+		reported := false
+		for {
+			select {
+			case <-ticker.C:
+				reporter.HashProgress(int(done.Load()), len(entries), hashedBytes.Load())
+				reported = true
+			case <-stop:
+				if reported {
+					reporter.HashProgress(int(done.Load()), len(entries), hashedBytes.Load())
+				}
+				return
+			}
+		}
+	}()
+
+	for i := range entries {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	close(stop)
+	<-progressDone
+	return res
+}
+
+// md5OfFileMmap hashes f through a read-only memory mapping.
+func md5OfFileMmap(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() < mmapMinSize || int64(int(info.Size())) != info.Size() {
+		return "", errMmapUnsupported
+	}
+	data, unmap, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return "", err
+	}
+	defer unmap()
+	return fmt.Sprintf("%x", md5.Sum(data)), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeRandomFile writes size pseudo random bytes to a temp file, returning
+// its name and MD5.
+func writeRandomFile(tb testing.TB, size int) (string, string) {
+	tb.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	fileName := filepath.Join(tb.TempDir(), "random.bin")
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return fileName, fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func TestMmapHashMatchesStreaming(t *testing.T) {
+	for _, size := range []int{0, 1000, mmapMinSize + 12345} {
+		fileName, want := writeRandomFile(t, size)
+		for _, mmap := range []bool{false, true} {
+			setupTest(t)
+			arg.MMap = mmap
+			got, err := md5OfFile(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("md5OfFile() of %d bytes with mmap %v = %s, want %s", size, mmap, got, want)
+			}
+		}
+	}
+
+	// small files are left to streaming
+	fileName, _ := writeRandomFile(t, 1000)
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := md5OfFileMmap(f); err != errMmapUnsupported {
+		t.Errorf("md5OfFileMmap() of a small file = %v, want %v", err, errMmapUnsupported)
+	}
+}
+
+func BenchmarkMD5OfFile(b *testing.B) {
+	fileName, _ := writeRandomFile(b, 64<<20)
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			saved := arg.MMap
+			defer func() { arg.MMap = saved }()
+			arg.MMap = mmap
+			b.SetBytes(64 << 20)
+			for i := 0; i < b.N; i++ {
+				if _, err := md5OfFile(fileName); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHashMismatchErrorType(t *testing.T) {
+	err := checkMD5([]byte("served"), md5Hex("expected"))
+	var mismatch *hashMismatchError
+	if !errors.As(fmt.Errorf("downloading a.txt: %w", err), &mismatch) {
+		t.Fatalf("checkMD5() = %v, not a *hashMismatchError", err)
+	}
+	if mismatch.Expected != md5Hex("expected") || mismatch.Actual != md5Hex("served") || mismatch.ErrorPage {
+		t.Errorf("mismatch = %+v", mismatch)
+	}
+	if err := checkMD5([]byte("<!DOCTYPE html><html><body>Not Found</body></html>"), md5Hex("expected")); !errors.As(err, &mismatch) || !mismatch.ErrorPage {
+		t.Errorf("checkMD5() of an error page = %v, want ErrorPage set", err)
+	}
+	if err := checkMD5([]byte("expected"), md5Hex("expected")); err != nil {
+		t.Errorf("checkMD5() of matching data = %v", err)
+	}
+}
+
+func TestDownloadFileReturnsHashMismatch(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"bad.txt": "bad", "gone.txt": "gone"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) {
+		files["bad.txt"] = []byte("tampered")
+		delete(files, "gone.txt")
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newRunReport(rootPath, list.Version)
+
+	var mismatch *hashMismatchError
+	for _, dl := range list.Downloads {
+		err := list.downloadFile(rootPath, dl, report)
+		if isMismatch := errors.As(err, &mismatch); isMismatch != (dl.Name == "bad.txt") {
+			t.Errorf("downloadFile(%s) = %v, hash mismatch %v", dl.Name, err, isMismatch)
+		}
+	}
+	if mismatch == nil || mismatch.Actual != md5Hex("tampered") {
+		t.Errorf("mismatch = %+v", mismatch)
+	}
+
+	// also for patched files
+	writeTestFiles(t, rootPath, map[string]string{"file.txt": patchOld})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { files["file.txt.bsdiff"] = testPatch(t) })
+	dl := fileEntry{Name: "file.txt", MD5: md5Hex("not what the patch makes"), Patch: &filePatch{Name: "file.txt.bsdiff", SourceMD5: md5Hex(patchOld)}}
+	if _, err := list.patchFile(filepath.Join(rootPath, "file.txt"), dl); !errors.As(err, &mismatch) {
+		t.Errorf("patchFile() = %v, not a *hashMismatchError", err)
+	}
+}
+
+func TestErrorPageIsDiagnosed(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) {
+		files["a.txt"] = []byte("<html><head><title>404</title></head><body>File not found</body></html>")
+		files["b.txt"] = []byte("not an error page")
+	})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := map[string]string{}
+	for _, f := range report.Failed {
+		errs[f.Name] = f.Error
+	}
+	if !strings.HasPrefix(errs["a.txt"], "server returned an error page") {
+		t.Errorf("a.txt failed with %q, want it diagnosed as an error page", errs["a.txt"])
+	}
+	if !strings.HasPrefix(errs["b.txt"], "got MD5") {
+		t.Errorf("b.txt failed with %q, want a plain mismatch", errs["b.txt"])
+	}
+	if !strings.Contains(out.String(), "server returned an error page instead of the file") {
+		t.Errorf("error page not reported:\n%s", out)
+	}
+}
+
+// hashProgressRecorder records the hashing progress events.
+type hashProgressRecorder struct {
+	plainReporter
+	mu     sync.Mutex
+	events [][3]int64
+}
+
+func (r *hashProgressRecorder) HashProgress(done, total int, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, [3]int64{int64(done), int64(total), bytes})
+}
+
+// slowStorage takes delay to hash each file.
+type slowStorage struct {
+	osStorage
+	delay time.Duration
+}
+
+func (s slowStorage) Hash(fileName string) (string, int64, error) {
+	time.Sleep(s.delay)
+	return s.osStorage.Hash(fileName)
+}
+
+func TestHashingReportsProgress(t *testing.T) {
+	saved := hashProgressInterval
+	hashProgressInterval = 5 * time.Millisecond
+	t.Cleanup(func() { hashProgressInterval = saved })
+	rootPath := t.TempDir()
+	files := map[string]string{}
+	entries := []fileEntry{}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		files[name] = strings.Repeat("x", 100)
+		entries = append(entries, fileEntry{Name: name})
+	}
+	writeTestFiles(t, rootPath, files)
+	entries = append(entries, fileEntry{Name: "missing.txt"})
+	setupTest(t, "patch", rootPath, "--hash-workers", "2")
+	storage = slowStorage{delay: 10 * time.Millisecond}
+	r := &hashProgressRecorder{}
+	reporter = r
+
+	hashLocalFiles(rootPath, entries)
+	if len(r.events) < 2 {
+		t.Fatalf("%d progress events, want several", len(r.events))
+	}
+	for i, event := range r.events {
+		if event[1] != 9 || (i > 0 && (event[0] < r.events[i-1][0] || event[2] < r.events[i-1][2])) {
+			t.Errorf("event %d: %d/%d files, %d bytes, after %v", i, event[0], event[1], event[2], r.events[:i])
+		}
+	}
+	if last := r.events[len(r.events)-1]; last != [3]int64{9, 9, 800} {
+		t.Errorf("last event: %d/%d files, %d bytes, want 9/9 and 800", last[0], last[1], last[2])
+	}
+
+	// quick runs print nothing
+	hashProgressInterval = time.Hour
+	r.events = nil
+	storage = osStorage{}
+	hashLocalFiles(rootPath, entries)
+	if len(r.events) != 0 {
+		t.Errorf("%d progress events for a quick run, want none", len(r.events))
+	}
+}
@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMaxOpenFilesBoundsHashing(t *testing.T) {
+	// the files are named pipes, so each one hashed is held open until the
+	// test writes to it and closes it
+	rootPath := t.TempDir()
+	entries := []fileEntry{}
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("file%d.bin", i)
+		if err := syscall.Mkfifo(filepath.Join(rootPath, name), 0644); err != nil {
+			t.Skip("can't create named pipes:", err)
+		}
+		entries = append(entries, fileEntry{Name: name})
+	}
+	setupTest(t, "patch", rootPath, "--hash-workers", "6", "--max-open-files", "3")
+
+	done := make(chan []localHash)
+	go func() { done <- hashLocalFiles(rootPath, entries) }()
+	finished := 0
+	for finished < len(entries) {
+		time.Sleep(20 * time.Millisecond)
+		// a pipe can only be opened for writing without blocking once it is
+		// opened for reading
+		open := []*os.File{}
+		for _, entry := range entries {
+			if f, err := os.OpenFile(filepath.Join(rootPath, entry.Name), os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				open = append(open, f)
+			}
+		}
+		if len(open) == 0 || len(open) > 3 {
+			t.Fatalf("%d files open at once after %d were hashed, want 1 to 3", len(open), finished)
+		}
+		for _, f := range open {
+			f.Write([]byte("data"))
+			f.Close()
+		}
+		finished += len(open)
+	}
+	for i, res := range <-done {
+		if res.err != nil || res.md5 != md5Hex("data") {
+			t.Errorf("%s hashed to %s, %v", entries[i].Name, res.md5, res.err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+)
+
+var hostLimits = newHostLimiter(0)
+
+// hostLimiter bounds the number of simultaneous requests per hostname,
+// on top of the global worker count.
+type hostLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, sems: map[string]chan struct{}{}}
+}
+
+// acquire blocks until a request to the host of rawURL may start, and returns
+// a function releasing the slot again.
+func (l *hostLimiter) acquire(rawURL string) func() {
+	if l.limit <= 0 {
+		return func() {}
+	}
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	l.mu.Lock()
+	sem, ok := l.sems[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.sems[host] = sem
+	}
+	l.mu.Unlock()
+
+	sem <- struct{}{}
+	return func() { <-sem }
+}
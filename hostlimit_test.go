@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyPerHostLimitsRequests(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 12; i++ {
+		files[fmt.Sprintf("file%02d.txt", i)] = fmt.Sprint("content ", i)
+	}
+	srv := newTestServer(t, files)
+	var mu sync.Mutex
+	active, peak := 0, 0
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		handler.ServeHTTP(w, r)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--workers", "8", "--concurrency-per-host", "2")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != len(files) {
+		t.Fatalf("downloaded %d files, want %d", len(report.Downloaded), len(files))
+	}
+	if peak > 2 {
+		t.Errorf("%d simultaneous requests, want at most 2", peak)
+	}
+}
+
+func TestHostLimiterIsPerHost(t *testing.T) {
+	l := newHostLimiter(1)
+	release := l.acquire("http://a.example.com/file")
+	done := make(chan struct{})
+	go func() {
+		l.acquire("http://b.example.com/file")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a request to another host was blocked")
+	}
+	release()
+}
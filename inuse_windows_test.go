@@ -0,0 +1,86 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryInUse(t *testing.T) {
+	setupTest(t)
+	saved := inUseRetryDelay
+	inUseRetryDelay = time.Millisecond
+	t.Cleanup(func() { inUseRetryDelay = saved })
+	inUse := &os.LinkError{Op: "rename", Old: "a.txt.tmp", New: "a.txt", Err: errorSharingViolation}
+
+	calls := 0
+	err := retryInUse("a.txt", func() error {
+		calls++
+		if calls < 3 {
+			return inUse
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("retryInUse() = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = retryInUse("a.txt", func() error {
+		calls++
+		return inUse
+	})
+	if !errors.Is(err, errorSharingViolation) || !strings.Contains(err.Error(), "close the game") || calls != inUseAttempts {
+		t.Errorf("retryInUse() = %v after %d calls, want a hint to close the game after %d", err, calls, inUseAttempts)
+	}
+
+	calls = 0
+	err = retryInUse("a.txt", func() error {
+		calls++
+		return os.ErrPermission
+	})
+	if err != os.ErrPermission || calls != 1 {
+		t.Errorf("retryInUse() = %v after %d calls, want other errors returned at once", err, calls)
+	}
+}
+
+func TestInstallFileRetriesRenameInUse(t *testing.T) {
+	setupTest(t)
+	saved := inUseRetryDelay
+	inUseRetryDelay = time.Millisecond
+	t.Cleanup(func() { inUseRetryDelay = saved })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a"})
+	calls := 0
+	rename = func(src, dst string) error {
+		calls++
+		if calls < 3 {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: errorSharingViolation}
+		}
+		return os.Rename(src, dst)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+
+	if err := (&fileListYaml{}).installFile(filepath.Join(rootPath, "a.txt"), []byte("new a")); err != nil || calls != 3 {
+		t.Errorf("installFile() = %v after %d renames, want success after 3", err, calls)
+	}
+	if got := readTestFile(t, rootPath, "a.txt"); got != "new a" {
+		t.Errorf("a.txt = %q, want %q", got, "new a")
+	}
+}
+
+func TestIsFileInUse(t *testing.T) {
+	for _, errno := range []error{errorSharingViolation, errorLockViolation} {
+		if !isFileInUse(&os.PathError{Op: "open", Path: "a.txt", Err: errno}) {
+			t.Errorf("isFileInUse(%v) = false", errno)
+		}
+	}
+	if isFileInUse(os.ErrNotExist) {
+		t.Error("isFileInUse(os.ErrNotExist) = true")
+	}
+}
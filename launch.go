@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// launchAfterPatch starts --launch in rootPath unless patching it failed or
+// was interrupted, or the run only tested or previewed the patch without
+// applying it. It returns whether the run failed, including launching.
+func launchAfterPatch(rootPath string, failed bool) bool {
+	if arg.Launch == "" || failed || cancelled() || arg.SpeedTest || arg.DryRun || arg.CleanupOnly {
+		return failed
+	}
+	if err := launchGame(rootPath); err != nil {
+		fmt.Fprintln(stdout, "ERROR:", err)
+		return true
+	}
+	return false
+}
+
+// launchGame starts --launch with --launch-arg in rootPath, without waiting
+// for it. A relative --launch is looked up in rootPath first, then in PATH.
+func launchGame(rootPath string) error {
+	name := arg.Launch
+	if !filepath.IsAbs(name) {
+		if inRoot := filepath.Join(rootPath, name); fileOrDirExists(inRoot) {
+			name = inRoot
+		}
+	}
+	cmd := exec.Command(name, arg.LaunchArg...)
+	cmd.Dir = rootPath
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not launch the game: %w", err)
+	}
+	fmt.Fprintln(stdout, "Launched", cmd.String())
+	return cmd.Process.Release()
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+import "os/exec"
+
+// detach does nothing where processes can't be detached.
+func detach(cmd *exec.Cmd) {}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLaunchOnlyAfterSuccessfulPatch(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	// launch.sh records that it ran, in which folder and with which
+	// arguments, renaming the record into place so it is never seen half
+	// written
+	script := "#!/bin/sh\necho \"$PWD $*\" > launched.tmp && mv launched.tmp launched.txt\n"
+	tests := []struct {
+		name           string
+		args           []string
+		prepare        func()
+		launch, failed bool
+	}{
+		{"success", nil, func() {}, true, false},
+		{"interrupted", nil, func() { cancelRun() }, false, true},
+		// nothing is patched by these
+		{"speed test", []string{"--speed-test"}, func() {}, false, false},
+		{"dry run", []string{"--dry-run"}, func() {}, false, false},
+		{"failed download", nil, func() {
+			srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "b.txt") })
+		}, false, true},
+	}
+	for _, tt := range tests {
+		rootPath, err := normalizeRoot(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(rootPath, "launch.sh"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"--retries", "0", "--launch", "launch.sh", "--launch-arg=-patchme", "--launch-arg", "two words"}, tt.args...)
+		setupTest(t, srv.patchArgs(rootPath, args...)...)
+		tt.prepare()
+
+		_, failed, _ := patchRoots([]string{rootPath}, time.Time{})
+		if failed = launchAfterPatch(rootPath, failed); failed != tt.failed {
+			t.Errorf("%s: run failed %v", tt.name, failed)
+		}
+		launched := filepath.Join(rootPath, "launched.txt")
+		if !tt.launch {
+			time.Sleep(50 * time.Millisecond)
+			if fileOrDirExists(launched) {
+				t.Errorf("%s: the game was launched", tt.name)
+			}
+			continue
+		}
+		// it is not waited for
+		deadline := time.Now().Add(5 * time.Second)
+		for readTestFile(t, rootPath, "launched.txt") == "<missing>" && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got, want := readTestFile(t, rootPath, "launched.txt"), rootPath+" -patchme two words\n"; got != want {
+			t.Errorf("%s: launched.txt = %q, want %q", tt.name, got, want)
+		}
+	}
+}
@@ -6,126 +6,1090 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"gopkg.in/yaml.v3"
 )
 
+// stdout receives all regular output. It must stay unbuffered (os.Stdout
+// writes straight to the file descriptor), so programs reading it through
+// a pipe see each line as soon as it is printed.
+var stdout io.Writer = os.Stdout
+
 var arg struct {
-	EverquestRoot string `arg:"" help:"Root folder to patch." type:"existingdir"`
-	Verbose       bool
-	Expansion     string `required:"" enum:"original,kunark"`
-	Client        string `required:"" enum:"rof"` // rof is for the rof2 client
+	Patch        patchCmd        `cmd:"" default:"withargs" help:"Patch the install (default command)."`
+	Status       statusCmd       `cmd:"" help:"Check if the install is current without modifying it. Exits 0 if current, 1 if not and 2 on errors."`
+	Config       configCmd       `cmd:"" help:"Print the effective configuration from flags, environment and defaults as YAML, with secrets redacted."`
+	ListCache    listCacheCmd    `cmd:"" help:"List the cached filelists with their version and age."`
+	Benchmark    benchmarkCmd    `cmd:"" help:"Measure the disk write and hashing throughput of the install's volume."`
+	ListOutdated listOutdatedCmd `cmd:"" help:"Print the names of the files that are missing or outdated, one per line, without modifying anything."`
+	Trash        trashCmd        `cmd:"" help:"Manage the files moved to the trash by --delete-to-trash."`
+	VerifyFile   verifyFileCmd   `cmd:"" help:"Check a single file of the install against the filelist. Exits 0 if it matches, 1 if not and 2 on errors."`
+
+	Verbose   bool
+	Quiet     bool   `help:"Print nothing if the install was already current, only when files were changed or errors occurred."`
+	Expansion string `help:"Expansion of the server (original, kunark). Detected from the install if omitted."`
+	Client    string `help:"Client to patch (rof). Detected from the install if omitted."` // rof is for the rof2 client
+
+	Retries                int           `default:"3" help:"Number of times to retry a failed download."`
+	RetryBaseDelay         time.Duration `default:"1s" help:"Delay before the first retry, doubled for each following retry."`
+	RetryMaxDelay          time.Duration `default:"30s" help:"Upper bound of the delay between retries."`
+	RetryJitter            float64       `default:"0.2" help:"Fraction (0-1) of the delay to randomly shave off each retry."`
+	RetryDNSNotFound       bool          `name:"retry-dns-not-found" help:"Also retry when a host name is not found, which some resolvers report while the network comes back up after sleep. Other DNS failures are always retried."`
+	MaxTotalRetries        int           `help:"Maximum number of retries for the whole run, after which failed requests aren't retried (0 for no limit)."`
+	ManifestURL            string        `env:"FVPATCHER_MANIFEST_URL" help:"Override the URL of the filelist manifest."`
+	VerifyAfter            bool          `help:"Re-hash every written file after downloading to confirm it landed correctly on disk."`
+	Workers                int           `default:"4" env:"FVPATCHER_WORKERS" help:"Number of files to download in parallel."`
+	ConcurrencyPerHost     int           `env:"FVPATCHER_CONCURRENCY_PER_HOST" help:"Maximum number of parallel downloads from a single host (0 for no limit)."`
+	MaxConsecutiveFailures int           `default:"10" help:"Abort the run after this many downloads failed in a row (0 to never abort)."`
+	ReportUnchanged        bool          `help:"Include files that were already up to date in the output and report."`
+	FileMode               octalMode     `help:"Permissions of written files, in octal (e.g. 0644). Defaults to 0666 minus umask."`
+	DirMode                octalMode     `help:"Permissions of created directories, in octal (e.g. 0755). Defaults to 0777 minus umask."`
+	Since                  string        `help:"Only download entries dated on or after this date (YYYY-MM-DD)."`
+	IncludeUndated         bool          `help:"With --since, also download entries without a valid date."`
+	TUI                    bool          `name:"tui" help:"Show download progress in an interactive terminal view."`
+	Mirror                 []string      `help:"Alternative download prefix mirroring the manifest's DownloadPrefix. Can be repeated."`
+	SpeedTest              bool          `help:"Measure latency and throughput of the download prefix and each --mirror, then exit."`
+	UseFastestMirror       bool          `help:"Run the speed test and download from the fastest mirror."`
+	WorkersAuto            bool          `help:"Adjust the number of parallel downloads to the connection, between 1 and --workers."`
+	HashWorkers            int           `help:"Number of local files to hash in parallel (0 for one per CPU)."`
+	MaxOpenFiles           int           `help:"Maximum number of files held open at once while hashing, for systems with a low file descriptor limit (0 for no limit)."`
+	MMap                   bool          `name:"mmap" help:"Memory-map large files when hashing them."`
+	DryRun                 bool          `help:"Show what would be deleted and downloaded without changing anything."`
+	CheckServer            bool          `help:"With --dry-run, send a HEAD request for each needed file to confirm the server has it with the expected size."`
+	SourceDir              string        `type:"existingdir" help:"Copy files from this local folder instead of downloading them. A filelist_<client>.yml in it is used as manifest."`
+	DeleteThreshold        int           `default:"100" help:"Refuse manifests deleting more files than this, unless --yes-delete-anything is given."`
+	YesDeleteAnything      bool          `help:"Process deletes even if there are more than --delete-threshold of them."`
+	Segments               int           `default:"1" help:"Download large files in this many parallel byte ranges, if the server supports it."`
+	ParallelRoots          bool          `help:"Patch multiple root folders concurrently."`
+	AllowStale             bool          `default:"true" negatable:"" help:"Use an outdated cached filelist if it can't be refreshed."`
+	Exclude                []string      `help:"Glob pattern of files to never delete or overwrite. Can be repeated."`
+	ExcludeFrom            string        `type:"existingfile" help:"File with exclude patterns, one per line."`
+	ManifestPublicKey      string        `env:"FVPATCHER_MANIFEST_PUBLIC_KEY" help:"minisign public key the filelist must be signed with."`
+	NoVerifySignature      bool          `help:"Don't check the signature of the filelist."`
+	ExpectVersion          string        `help:"Abort unless the filelist has this version."`
+	Diagnose               bool          `help:"After the run, write a diagnostics file to attach to bug reports. Secrets are redacted and nothing is sent anywhere."`
+	BundleThreshold        int           `default:"20" help:"Use the filelist's zip bundle when at least this many files need downloading."`
+	CompareWithRemote      bool          `help:"Compare the size and first bytes of each local file with the server's copy without downloading it, listing files that look diverged. Exits 1 if any do."`
+	PrintURLOnly           bool          `name:"print-url-only" help:"Print the filelist URL and the first download URLs from the cached filelist, without fetching anything."`
+	PrintURLCount          int           `name:"print-url-count" default:"10" help:"Number of download URLs printed by --print-url-only."`
+	MaxIdleConns           int           `default:"100" help:"Maximum number of idle connections kept open for reuse."`
+	MaxIdleConnsPerHost    int           `default:"16" help:"Maximum number of idle connections kept open per host. Should be at least --workers."`
+	IdleConnTimeout        time.Duration `default:"90s" help:"How long idle connections are kept open."`
+	ConnectTimeout         time.Duration `default:"10s" help:"How long to wait for a connection to a server to be established."`
+	ReadTimeout            time.Duration `default:"30s" help:"How long to wait for data from a server before giving up on the request. Slow but steady downloads are never cut off, unless --min-speed is set."`
+	MinSpeed               byteSize      `placeholder:"SIZE" help:"Give up on a download that would be slower than this per second, such as 50K, judged by the time it takes compared to the size in the filelist."`
+	TmpDir                 string        `type:"existingdir" help:"Stage downloads in this folder before moving them into the install, e.g. on a faster disk."`
+	SkipLargerThan         byteSize      `placeholder:"SIZE" help:"Don't download files larger than this, such as 500M, listing them as deferred instead."`
+	MaxTotalBytes          byteSize      `placeholder:"SIZE" help:"Stop starting downloads once this much, such as 2G, was downloaded in the run, leaving the rest for a later run. Uses the sizes in the filelist."`
+	RetryFailed            bool          `help:"Only process the files that failed in the last run."`
+	AssumeRootClean        bool          `help:"Skip hashing the local files if the last run applied the same filelist version, only downloading missing files. For launchers managing the install exclusively."`
+	FreshInstall           bool          `help:"Download every file without checking for existing ones, to set up a new install in an empty folder."`
+	CleanupOnly            bool          `help:"Only apply the deletes, listing the files that need downloading without downloading them."`
+	KeepBadDownloads       bool          `help:"Save downloads with the wrong MD5 as <file>.bad for inspection instead of overwriting the local file."`
+	KeepUserModified       bool          `help:"Don't overwrite files whose MD5 matches neither the filelist nor the one applied before, as they were likely changed by the user."`
+	DeleteToTrash          bool          `help:"Move deleted files to the trash instead of removing them, so they can be restored. Remove them with the trash empty command."`
+	TrashDir               string        `help:"Folder for --delete-to-trash, which keeps the files in a fvpatcher-trash folder in it. Defaults to trash in the settings dir."`
+	VerifyDeletes          bool          `help:"Check that deleted files are really gone afterwards."`
+	Proxy                  string        `env:"FVPATCHER_PROXY" help:"URL of the HTTP proxy to use. Defaults to the HTTP_PROXY and HTTPS_PROXY environment variables."`
+	BasicAuth              string        `env:"FVPATCHER_BASIC_AUTH" help:"Credentials as user:password for servers requiring basic authentication. Prefer the environment variable to keep it out of the process list."`
+	AllowHTTPFallback      bool          `name:"allow-http-fallback" help:"Retry over plain HTTP when a HTTPS connection fails, for old mirrors. Downloads are still checked against their MD5."`
+	InsecureSkipTLSVerify  bool          `name:"insecure-skip-tls-verify" help:"Don't verify the TLS certificates of servers, for mirrors with self-signed or expired certificates. Downloads are still checked against their MD5."`
+	SettingsDir            string        `env:"FVPATCHER_SETTINGS_DIR" help:"Folder for the cached filelists and logs. Defaults to ~/.config/fvpatcher."`
+	SkipValidation         bool          `help:"Apply the filelist even if it fails validation."`
+	RepairManifestCache    bool          `help:"Re-download the cached filelist, keeping the old copy if that fails, then exit without touching any game files."`
+	DumpManifest           string        `placeholder:"FILE" type:"existingfile" help:"Print the filelist in FILE in a normalized form with sorted entries, for diffing filelists, then exit."`
+	PrefetchManifest       bool          `help:"Make sure a fresh filelist is cached, then exit without looking at the game files. For launchers warming the cache."`
+	TouchManifestCache     bool          `help:"When everything is already current, reset the age of the cached filelist so the next run doesn't fetch it again."`
+	RefreshInterval        time.Duration `help:"Keep running after patching, checking the filelist at this interval and patching again when its version changes, until interrupted. For launchers."`
+	RefreshManifest        bool          `help:"Fetch the filelist even if the cached copy is recent."`
+	ManifestOnly           bool          `help:"Load and validate the filelist and print a summary of it, then exit without touching any game files."`
+	ChecksumOnly           bool          `help:"Print the checksums of the local files listed in the cached filelist, sorted by name, without using the network or changing anything."`
+	SHA256                 bool          `name:"sha256" help:"With --checksum-only, also print SHA-256 checksums."`
+	Launch                 string        `placeholder:"PATH" help:"Program to start in the install folder after a successful patch, such as eqgame.exe. Looked up in the install folder first, then in PATH."`
+	LaunchArg              []string      `placeholder:"ARG" help:"Argument for --launch. Can be repeated."`
+	JSONReport             string        `name:"json-report" help:"Write a JSON report of the run to this file."`
+}
+
+type patchCmd struct {
+	EverquestRoots []string `arg:"" optional:"" name:"everquest-root" help:"Root folders to patch. Defaults to $FVPATCHER_ROOT." type:"existingdir"`
+}
+
+type listCacheCmd struct{}
+
+type statusCmd struct {
+	EverquestRoot string `arg:"" optional:"" help:"Root folder to check. Defaults to $FVPATCHER_ROOT." type:"existingdir"`
+}
+
+type listOutdatedCmd struct {
+	EverquestRoot string `arg:"" optional:"" help:"Root folder to check. Defaults to $FVPATCHER_ROOT." type:"existingdir"`
+	JSON          bool   `name:"json" help:"Print the names as a JSON array."`
 }
 
 func main() {
-	kong.Parse(&arg)
+	defer writeCrashDiagnostics()
+	ctx := kong.Parse(&arg)
+	command := strings.Fields(ctx.Command())[0]
+	if command == "config" {
+		ctx.FatalIfErrorf(printConfig(ctx))
+		return
+	}
+	if command == "list-cache" {
+		ctx.FatalIfErrorf(listCache())
+		return
+	}
+	if arg.DumpManifest != "" {
+		ctx.FatalIfErrorf(dumpManifest(arg.DumpManifest))
+		return
+	}
+	if command == "trash" {
+		ctx.FatalIfErrorf(emptyTrash(arg.Trash.Empty.OlderThan))
+		return
+	}
+	if command == "benchmark" {
+		ctx.FatalIfErrorf(runBenchmark(arg.Benchmark.EverquestRoot))
+		return
+	}
+	ctx.FatalIfErrorf(validateRetryArgs())
+	ctx.FatalIfErrorf(validateNetworkArgs())
+	if arg.Workers < 1 {
+		ctx.Fatalf("--workers must be at least 1, got %d", arg.Workers)
+	}
+	if arg.Launch != "" && len(arg.Patch.EverquestRoots) > 1 {
+		ctx.Fatalf("--launch can't be used with more than one root folder")
+	}
+	if arg.MaxOpenFiles < 0 {
+		ctx.Fatalf("--max-open-files must be 0 or more, got %d", arg.MaxOpenFiles)
+	}
+	var quietOutput *quietBuffer
+	if arg.Quiet && command == "patch" {
+		quietOutput = &quietBuffer{}
+		stdout = quietOutput
+	}
+	hostLimits = newHostLimiter(arg.ConcurrencyPerHost)
+	if arg.MaxOpenFiles > 0 {
+		hashOpenFiles = make(chan struct{}, arg.MaxOpenFiles)
+	}
+	resetRunState()
+	reporter = newReporter(arg.TUI && !arg.Quiet)
+	var since time.Time
+	if arg.Since != "" {
+		var err error
+		since, err = parseEntryDate(arg.Since)
+		ctx.FatalIfErrorf(err, "--since")
+	}
+	excludePatterns = arg.Exclude
+	if arg.ExcludeFrom != "" {
+		patterns, err := loadExcludeFile(arg.ExcludeFrom)
+		ctx.FatalIfErrorf(err)
+		excludePatterns = append(excludePatterns, patterns...)
+	}
+
+	if command == "status" || command == "list-outdated" || command == "verify-file" {
+		code, err := runCheckCommand(command, os.Stdout)
+		ctx.FatalIfErrorf(err)
+		os.Exit(code)
+	}
+
+	roots, err := rootsOrEnv(arg.Patch.EverquestRoots)
+	ctx.FatalIfErrorf(err)
+	roots, err = normalizeRoots(roots)
+	ctx.FatalIfErrorf(err)
+	if arg.RepairManifestCache {
+		for _, rootPath := range roots {
+			ctx.FatalIfErrorf(repairManifestCache(rootPath))
+		}
+		return
+	}
+	if arg.PrefetchManifest {
+		for _, rootPath := range roots {
+			ctx.FatalIfErrorf(prefetchManifest(rootPath))
+		}
+		return
+	}
+	if arg.ManifestOnly {
+		for _, rootPath := range roots {
+			ctx.FatalIfErrorf(checkManifest(rootPath))
+		}
+		return
+	}
+	if arg.ChecksumOnly {
+		for _, rootPath := range roots {
+			ctx.FatalIfErrorf(printChecksums(rootPath))
+		}
+		return
+	}
+	if arg.CompareWithRemote {
+		diverged := 0
+		for _, rootPath := range roots {
+			n, err := compareWithRemote(rootPath)
+			ctx.FatalIfErrorf(err)
+			diverged += n
+		}
+		if diverged > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if arg.PrintURLOnly {
+		for _, rootPath := range roots {
+			ctx.FatalIfErrorf(printURLs(rootPath, arg.PrintURLCount))
+		}
+		return
+	}
+	handleInterrupt()
+	reports, failed, changed := patchRoots(roots, since)
+	if arg.Diagnose {
+		fileName, err := writeDiagnostics("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(stdout, "Diagnostics written to", fileName)
+	}
+	failed = launchAfterPatch(roots[0], failed)
+	if quietOutput != nil {
+		quietOutput.flush(os.Stdout, changed || failed)
+	}
+	if arg.RefreshInterval > 0 {
+		failed = watchForUpdates(roots, since, reports, quietOutput)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// resetRunState resets the budgets and state that apply to one run, which
+// --refresh-interval repeats. The TUI resets its counters when downloads are
+// queued.
+func resetRunState() {
+	downloadBudget = &byteBudget{limit: uint64(arg.MaxTotalBytes)}
+	totalRetries.Store(0)
+	retryBudgetExhausted = sync.Once{}
+	trashRunStarted = time.Now()
+}
+
+// patchRoots patches the roots and prints their summaries, returning the
+// reports, whether any root failed and whether anything changed.
+func patchRoots(roots []string, since time.Time) ([]*runReport, bool, bool) {
+	reports := make([]*runReport, len(roots))
+	errs := make([]error, len(roots))
+	if arg.ParallelRoots {
+		var wg sync.WaitGroup
+		for i, rootPath := range roots {
+			wg.Add(1)
+			go func(i int, rootPath string) {
+				defer wg.Done()
+				defer writeCrashDiagnostics()
+				reports[i], errs[i] = patchRoot(rootPath, since)
+			}(i, rootPath)
+		}
+		wg.Wait()
+	} else {
+		for i, rootPath := range roots {
+			if cancelled() {
+				errs[i] = fmt.Errorf("skipped, the run was interrupted")
+				continue
+			}
+			if len(roots) > 1 {
+				fmt.Fprintln(stdout, "Patching", rootPath)
+			}
+			reports[i], errs[i] = patchRoot(rootPath, since)
+		}
+	}
+
+	failed, changed := false, false
+	for i, rootPath := range roots {
+		if len(roots) > 1 {
+			fmt.Fprintln(stdout, "Summary of", rootPath)
+		}
+		if errs[i] != nil {
+			fmt.Fprintln(stdout, "ERROR:", errs[i])
+			failed = true
+			continue
+		}
+		reports[i].PrintSummary()
+		if len(reports[i].Failed) > 0 || reports[i].Aborted != "" {
+			failed = true
+		}
+		if reports[i].hasChanges() {
+			changed = true
+		}
+	}
+	if arg.JSONReport != "" {
+		if err := writeJSONReports(arg.JSONReport, roots, reports, errs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return reports, failed, changed
+}
 
-	list, err := DownloadFileList(arg.Client, arg.Expansion)
+// normalizeRoot returns rootPath as an absolute, clean path with symlinks
+// resolved, so it is the same however it was typed.
+func normalizeRoot(rootPath string) (string, error) {
+	abs, err := filepath.Abs(rootPath)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// normalizeRoots normalizes roots, dropping those given more than once.
+func normalizeRoots(roots []string) ([]string, error) {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, rootPath := range roots {
+		normalized, err := normalizeRoot(rootPath)
+		if err != nil {
+			return nil, err
+		}
+		if seen[normalized] {
+			fmt.Fprintln(stdout, "Ignoring", rootPath, "given more than once")
+			continue
+		}
+		seen[normalized] = true
+		res = append(res, normalized)
+	}
+	return res, nil
+}
+
+// rootsOrEnv returns roots, the root folders given on the command line, or
+// the one from $FVPATCHER_ROOT if there are none.
+func rootsOrEnv(roots []string) ([]string, error) {
+	if len(roots) > 0 {
+		return roots, nil
 	}
+	return envRoots()
+}
 
-	fmt.Println("Filelist manifest version", list.Version)
-	list.HandleDeleteRequests(arg.EverquestRoot)
-	list.HandleDownloadRequests(arg.EverquestRoot)
+// envRoots returns the root folder from $FVPATCHER_ROOT, for when none is
+// given on the command line.
+func envRoots() ([]string, error) {
+	rootPath := os.Getenv("FVPATCHER_ROOT")
+	if rootPath == "" {
+		return nil, fmt.Errorf("expected <everquest-root> argument or FVPATCHER_ROOT to be set")
+	}
+	if info, err := os.Stat(rootPath); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("FVPATCHER_ROOT: %q is not a folder", rootPath)
+	}
+	return []string{rootPath}, nil
 }
 
-func (list *fileListYaml) HandleDeleteRequests(rootPath string) {
-	fmt.Printf("Processing %d requests for deletes ...\n", len(list.Deletes))
+// loadFileList detects the expansion and client of rootPath and loads the
+// matching manifest.
+func loadFileList(rootPath string) (*fileListYaml, error) {
+	expansion, client, err := detectInstall(rootPath, arg.Expansion, arg.Client)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateInstallArgs(expansion, client); err != nil {
+		return nil, err
+	}
+	list, err := DownloadFileList(client, expansion)
+	if err != nil {
+		return nil, err
+	}
+	if arg.ExpectVersion != "" && list.Version != arg.ExpectVersion {
+		return nil, fmt.Errorf("filelist version is %s, expected %s. Aborting without changes", list.Version, arg.ExpectVersion)
+	}
+	list.expansion, list.client = expansion, client
+	list.allDownloads = list.Downloads
+	if list.excludes, err = rootExcludePatterns(rootPath); err != nil {
+		return nil, err
+	}
+	list.Deletes = filterExcluded(list.Deletes, list.excludes)
+	list.Downloads = filterExcluded(list.Downloads, list.excludes)
+	return list, nil
+}
+
+// patchRoot patches a single install. The returned report is nil if the
+// manifest couldn't be loaded or deletes were refused.
+func patchRoot(rootPath string, since time.Time) (*runReport, error) {
+	started := time.Now()
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(stdout, "Filelist manifest version", list.Version)
+	if !arg.SkipValidation {
+		if problems := list.Validate(); len(problems) > 0 {
+			fmt.Fprintf(stdout, "Filelist failed validation with %d problems:\n", len(problems))
+			for _, problem := range problems {
+				fmt.Fprintln(stdout, "-", problem)
+			}
+			return nil, fmt.Errorf("invalid filelist, nothing was changed. Pass --skip-validation to apply it anyway")
+		}
+	}
+	for _, warning := range list.sizeWarnings() {
+		fmt.Fprintln(stdout, "WARNING:", warning)
+	}
+	list.Deletes = skipUnsafeEntries(list.Deletes)
+	list.Downloads = skipUnsafeEntries(list.Downloads)
+	if arg.SpeedTest || arg.UseFastestMirror {
+		results := list.speedTestMirrors(arg.Mirror)
+		printSpeedTest(results)
+		if arg.SpeedTest {
+			return newRunReport(rootPath, list.Version), nil
+		}
+		if len(results) > 0 && results[0].Err == nil && results[0].Prefix != list.DownloadPrefix {
+			fmt.Fprintln(stdout, "Using fastest mirror", results[0].Prefix)
+			list.DownloadPrefix = results[0].Prefix
+		}
+	}
+	if len(arg.Mirror) > 0 {
+		list.mirrors = newMirrorHealth(append([]string{list.DownloadPrefix}, arg.Mirror...))
+	}
+	if arg.Since != "" {
+		list.Downloads = filterSince(list.Downloads, since, arg.IncludeUndated)
+	}
+	if arg.RetryFailed {
+		names, err := readFailedList(rootPath)
+		if err != nil {
+			return nil, err
+		}
+		list.Deletes = onlyNamed(list.Deletes, names)
+		list.Downloads = onlyNamed(list.Downloads, names)
+		fmt.Fprintf(stdout, "Retrying %d failed files\n", len(list.Deletes)+len(list.Downloads))
+	}
+	fmt.Fprintf(stdout, "%d of %d files current\n", list.currentBySize(rootPath), len(list.Downloads))
+	report := newRunReport(rootPath, list.Version)
+	if err := list.HandleDeleteRequests(rootPath, report); err != nil {
+		return nil, err
+	}
+	written := list.HandleDownloadRequests(rootPath, report)
+	if arg.VerifyAfter {
+		verifyWrittenFiles(rootPath, written, report)
+	}
+
+	if err := appendRunLog(getSettingsRoot(), newRunLogEntry(started, report)); err != nil {
+		log.Println("WARNING: could not write run log:", err)
+	}
+	if !arg.DryRun {
+		if err := writeFailedList(rootPath, report); err != nil {
+			log.Println("WARNING: could not save list of failed files:", err)
+		}
+		for _, warning := range list.totalsWarnings(rootPath) {
+			fmt.Fprintln(stdout, "WARNING:", warning)
+		}
+	}
+	if len(report.Failed) == 0 && report.Aborted == "" && !arg.DryRun && !arg.CleanupOnly {
+		state := installState{Expansion: list.expansion, Client: list.client}
+		if arg.Since == "" && !arg.RetryFailed && len(report.Deferred) == 0 {
+			state.Version = list.Version
+			if err := writeAppliedList(rootPath, list); err != nil {
+				log.Println("WARNING: could not save applied filelist:", err)
+			}
+		}
+		if err := writeInstallState(rootPath, state); err != nil {
+			log.Println("WARNING: could not save install state:", err)
+		}
+		if arg.TouchManifestCache && len(report.Deleted) == 0 && len(report.Downloaded) == 0 && len(report.Deferred) == 0 {
+			if err := touchManifestCache(list.client, list.expansion); err != nil {
+				log.Println("WARNING: could not touch cached filelist:", err)
+			}
+		}
+	}
+	return report, nil
+}
+
+func (list *fileListYaml) HandleDeleteRequests(rootPath string, report *runReport) error {
+	fmt.Fprintf(stdout, "Processing %d requests for deletes ...\n", len(list.Deletes))
+	deletes := list.expandDeletes(rootPath, report)
+	if len(deletes) > arg.DeleteThreshold && !arg.YesDeleteAnything && !arg.DryRun {
+		return fmt.Errorf("refusing to process %d deletes (more than %d), which may be a manifest mistake. Check with --dry-run and pass --yes-delete-anything to proceed", len(deletes), arg.DeleteThreshold)
+	}
 	deleteCount := 0
-	for _, del := range list.Deletes {
+	for _, del := range deletes {
 		fullPath := filepath.Join(rootPath, del.Name)
-		if fileOrDirExists(fullPath) {
-			fmt.Println("Deleting ", del.Name)
-			err := os.Remove(fullPath)
+		if storage.Exists(fullPath) {
+			if keepModified(rootPath, del) {
+				continue
+			}
+			if arg.DryRun {
+				fmt.Fprintln(stdout, "Would delete", del.Name)
+				continue
+			}
+			if arg.DeleteToTrash {
+				fmt.Fprintln(stdout, "Trashing ", del.Name)
+			} else {
+				fmt.Fprintln(stdout, "Deleting ", del.Name)
+			}
+			remove := storage.Remove
+			if del.Glob {
+				remove = storage.RemoveAll
+			}
+			if arg.DeleteToTrash {
+				remove = func(string) error { return moveToTrash(rootPath, del.Name) }
+			}
+			err := remove(fullPath)
 			if err != nil {
-				fmt.Println("- Delete failed:", err.Error())
+				fmt.Fprintln(stdout, "- Delete failed:", err.Error())
+				report.addFailure(del.Name, failFilesystem, err)
 			} else {
+				report.Deleted = append(report.Deleted, del.Name)
 				deleteCount++
 			}
 		}
 	}
-	fmt.Printf("- %d files deleted\n", deleteCount)
+	fmt.Fprintf(stdout, "- %d files deleted\n", deleteCount)
+	if arg.VerifyDeletes {
+		verifyDeleted(rootPath, report)
+	}
+	return nil
 }
 
-func (list *fileListYaml) HandleDownloadRequests(rootPath string) {
-	fmt.Printf("Processing %d requests for downloads ...\n", len(list.Downloads))
-	downloadCount := 0
-	for _, dl := range list.Downloads {
-		fullPath := filepath.Join(rootPath, dl.Name)
-		needDownload := false
-		if fileOrDirExists(fullPath) {
-			actualMD5, err := md5OfFile(fullPath)
-			if err != nil {
-				fmt.Println("ERROR:", err)
+func (list *fileListYaml) HandleDownloadRequests(rootPath string, report *runReport) []fileEntry {
+	fmt.Fprintf(stdout, "Processing %d requests for downloads ...\n", len(list.Downloads))
+	var needed []fileEntry
+	if arg.FreshInstall {
+		if entries, _ := storage.ReadDir(rootPath); len(entries) > 0 {
+			fmt.Fprintln(stdout, "WARNING: --fresh-install in a folder that is not empty, all files are downloaded again")
+		}
+		needed = append(needed, list.Downloads...)
+		if arg.Verbose {
+			fmt.Fprintln(stdout, "Downloading all files, forced by --fresh-install")
+		}
+	} else if arg.AssumeRootClean && list.appliedBefore(rootPath) {
+		fmt.Fprintf(stdout, "Version %s was applied before, only checking for missing files\n", list.Version)
+		needed = list.missingDownloads(rootPath)
+	} else {
+		needed = list.outdatedDownloads(rootPath, report)
+	}
+	if arg.SkipLargerThan > 0 {
+		needed = deferLargeDownloads(needed, uint64(arg.SkipLargerThan), report)
+	}
+	if arg.DryRun {
+		list.dryRunDownloads(needed, report)
+		return nil
+	}
+	if arg.CleanupOnly {
+		for _, dl := range needed {
+			fmt.Fprintln(stdout, "Needs download:", dl.Name)
+		}
+		fmt.Fprintf(stdout, "- %d files need downloading, run without --cleanup-only to download them\n", len(needed))
+		return nil
+	}
+
+	if arg.TmpDir != "" {
+		dir, err := os.MkdirTemp(arg.TmpDir, "fvpatcher-")
+		if err != nil {
+			reporter.Logf("ERROR: could not create staging dir, writing files in place: %v", err)
+		} else {
+			list.stagingDir = dir
+			defer func() {
+				os.RemoveAll(dir)
+				list.stagingDir = ""
+			}()
+		}
+	}
+
+	var mu sync.Mutex
+	written := []fileEntry{}
+	if list.Bundle != "" && arg.SourceDir == "" && len(needed) >= arg.BundleThreshold {
+		var extracted []fileEntry
+		extracted, needed = list.extractFromBundle(rootPath, needed, report)
+		written = append(written, extracted...)
+	}
+	needed, duplicates := splitDuplicates(needed)
+	needed = scheduleDownloads(rootPath, needed)
+	breaker := newFailureBreaker(arg.MaxConsecutiveFailures)
+	scaler := newWorkerScaler(arg.Workers, arg.WorkersAuto)
+	if arg.WorkersAuto {
+		done := make(chan struct{})
+		defer close(done)
+		go scaler.run(done)
+	}
+	reporter.DownloadsQueued(len(needed) + len(duplicates))
+	// fetch downloads dl unless the run is stopping or --max-total-bytes was
+	// reached, and reports whether it was written
+	fetch := func(dl fileEntry) bool {
+		if breaker.tripped() || cancelled() {
+			report.addPending(dl.Name)
+			return false
+		}
+		// empty files are created without downloading anything
+		if dl.MD5 != emptyMD5 && !downloadBudget.reserve(uint64(dl.Size)) {
+			reporter.Logf("Deferring %s (%s), --max-total-bytes reached", dl.Name, describeSize(dl))
+			report.addDeferred(dl.Name)
+			reporter.FileDone(dl.Name, nil)
+			return false
+		}
+		scaler.acquire()
+		err := list.downloadFile(rootPath, dl, report)
+		scaler.release(err)
+		if err != nil {
+			breaker.failure()
+			return false
+		}
+		breaker.success()
+		return true
+	}
+	queue := make(chan fileEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < arg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer writeCrashDiagnostics()
+			for dl := range queue {
+				if fetch(dl) {
+					mu.Lock()
+					written = append(written, dl)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i, dl := range needed {
+		if breaker.tripped() {
+			for _, dl := range needed[i:] {
+				report.addPending(dl.Name)
+			}
+			break
+		}
+		if cancelled() {
+			for _, dl := range needed[i:] {
+				report.addPending(dl.Name)
+			}
+			break
+		}
+		queue <- dl
+	}
+	close(queue)
+	wg.Wait()
+
+	if cancelled() {
+		report.Cancelled = true
+		report.Aborted = "interrupted"
+		for _, dl := range duplicates {
+			report.addPending(dl.Name)
+		}
+	} else if breaker.tripped() {
+		report.Aborted = fmt.Sprintf("%d downloads failed in a row, the server seems to be unavailable", arg.MaxConsecutiveFailures)
+		reporter.Logf("ERROR: Aborting downloads, %s", report.Aborted)
+		for _, dl := range duplicates {
+			report.addPending(dl.Name)
+		}
+	} else {
+		written = append(written, list.installDuplicates(rootPath, duplicates, written, fetch, report)...)
+	}
+	reporter.Close()
+
+	fmt.Fprintf(stdout, "- %d files downloaded\n", len(written))
+	return written
+}
+
+// outdatedDownloads returns the download entries that are missing or differ
+// locally.
+func (list *fileListYaml) outdatedDownloads(rootPath string, report *runReport) []fileEntry {
+	needed := []fileEntry{}
+	var applied map[string]string
+	if arg.KeepUserModified {
+		applied = readAppliedList(rootPath)
+	}
+	local := hashLocalFiles(rootPath, list.Downloads)
+	for i, dl := range list.Downloads {
+		if local[i].exists {
+			if local[i].err != nil {
+				fmt.Fprintln(stdout, "ERROR:", local[i].err)
+				report.addFailure(dl.Name, failFilesystem, local[i].err)
 				continue
 			}
-			if actualMD5 != dl.MD5 {
-				needDownload = true
-			} else {
+			if local[i].md5 == dl.MD5 {
 				if arg.Verbose {
-					fmt.Println("OK", dl.Name)
+					fmt.Fprintln(stdout, "OK", dl.Name, "(MD5 matches)")
+				} else if arg.ReportUnchanged {
+					fmt.Fprintln(stdout, "OK", dl.Name)
+				}
+				if arg.ReportUnchanged {
+					report.Unchanged = append(report.Unchanged, dl.Name)
 				}
+				continue
 			}
-		} else {
-			needDownload = true
+			if userModified(dl, local[i].md5, applied) {
+				fmt.Fprintln(stdout, "WARNING: keeping", dl.Name+", it was modified since the last update")
+				continue
+			}
+			if arg.Verbose {
+				fmt.Fprintln(stdout, "Outdated", dl.Name, "(local MD5 is "+local[i].md5+")")
+			}
+		} else if arg.Verbose {
+			fmt.Fprintln(stdout, "Missing", dl.Name)
 		}
+		needed = append(needed, dl)
+	}
+	return needed
+}
 
-		if needDownload {
-			fileURL := list.DownloadPrefix + dl.Name
-			fmt.Println("GET", fileURL)
-			data, err := fetchUrl(fileURL)
-			if err != nil {
-				log.Fatal(err)
+// appliedBefore reports whether the last run on rootPath fully applied this
+// version of the filelist.
+func (list *fileListYaml) appliedBefore(rootPath string) bool {
+	state, err := readInstallState(rootPath)
+	if err != nil || state.Version == "" {
+		fmt.Fprintln(stdout, "No record of the last applied version, checking all files")
+		return false
+	}
+	if state.Version != list.Version {
+		fmt.Fprintf(stdout, "Last applied version was %s, checking all files\n", state.Version)
+		return false
+	}
+	return true
+}
+
+// missingDownloads returns the download entries that don't exist locally,
+// without hashing the others.
+func (list *fileListYaml) missingDownloads(rootPath string) []fileEntry {
+	needed := []fileEntry{}
+	for _, dl := range list.Downloads {
+		if !storage.Exists(filepath.Join(rootPath, dl.Name)) {
+			if arg.Verbose {
+				fmt.Fprintln(stdout, "Missing", dl.Name)
 			}
-			downloadedMD5 := md5OfData(data)
-			if downloadedMD5 != dl.MD5 {
-				fmt.Println("ERROR: Downloaded MD5 does not match. Got ", downloadedMD5, ", expected ", dl.MD5, ". Writing to disk anyway!!!")
-				if err := writeFile(fullPath, data); err != nil {
-					log.Println("ERROR:", err)
-				}
-				downloadCount++
+			needed = append(needed, dl)
+		}
+	}
+	return needed
+}
+
+// downloadFile patches or downloads dl into rootPath. A file with an
+// unexpected MD5 is still written, or saved next to it with a .bad suffix
+// with --keep-bad-downloads, returning a *hashMismatchError.
+func (list *fileListYaml) downloadFile(rootPath string, dl fileEntry, report *runReport) (err error) {
+	defer func() { reporter.FileDone(dl.Name, err) }()
+	fullPath := filepath.Join(rootPath, dl.Name)
+	if dl.MD5 == emptyMD5 {
+		reporter.Logf("CREATE %s (empty)", dl.Name)
+		if err := list.installFile(fullPath, []byte{}); err != nil {
+			reporter.Logf("ERROR: %v", err)
+			report.addFailure(dl.Name, failFilesystem, err)
+			return err
+		}
+		report.addDownloaded(dl.Name)
+		return nil
+	}
+	if dl.Patch != nil {
+		data, err := list.patchFile(fullPath, dl)
+		if err == nil {
+			if err := list.installFile(fullPath, data); err != nil {
+				reporter.Logf("ERROR: %v", err)
+				report.addFailure(dl.Name, failFilesystem, err)
+				return err
 			}
+			report.addDownloaded(dl.Name)
+			return nil
+		}
+		if arg.Verbose {
+			reporter.Logf("- Patching %s failed, downloading full file: %v", dl.Name, err)
+		}
+	}
+
+	data, err := list.fetchFile(dl.Name, list.downloadURL(dl), dl.Size, dl.Compression != "")
+	if err == nil && dl.Compression == compressionZstd && arg.SourceDir == "" {
+		if data, err = zstdDecompress(data, maxDownloadSize(dl)); err != nil {
+			err = fmt.Errorf("decompressing %s: %w", list.downloadURL(dl), err)
+			reporter.Logf("ERROR: %v", err)
+			report.addFailure(dl.Name, failHashMismatch, err)
+			return err
+		}
+	}
+	if err != nil && cancelled() {
+		reporter.Logf("- Interrupted %s", dl.Name)
+		report.addInFlight(dl.Name)
+		return err
+	}
+	if err != nil {
+		reporter.Logf("ERROR: %v", err)
+		category := failNetwork
+		if arg.SourceDir != "" {
+			category = failFilesystem
+		}
+		report.addFailure(dl.Name, category, err)
+		return err
+	}
+	if dl.Size == 0 {
+		// not reserved up front, as the size wasn't known
+		downloadBudget.add(uint64(len(data)))
+	}
+	if warning := sizeMismatchWarning(dl, len(data)); warning != "" {
+		reporter.Logf("WARNING: %s", warning)
+	}
+	hashErr := checkMD5(data, dl.MD5)
+	if hashErr != nil && arg.KeepBadDownloads {
+		reporter.Logf("ERROR: Downloaded MD5 does not match, %v. Keeping it as %s", hashErr, fullPath+".bad")
+		report.addFailure(dl.Name, failHashMismatch, hashErr)
+		if err := storage.Write(fullPath+".bad", data); err != nil {
+			reporter.Logf("ERROR: %v", err)
+		}
+		return hashErr
+	}
+	if hashErr != nil {
+		reporter.Logf("ERROR: Downloaded MD5 does not match, %v. Writing to disk anyway!!!", hashErr)
+		report.addFailure(dl.Name, failHashMismatch, hashErr)
+	}
+	if err := list.installFile(fullPath, data); err != nil {
+		reporter.Logf("ERROR: %v", err)
+		report.addFailure(dl.Name, failFilesystem, err)
+		return err
+	}
+	report.addDownloaded(dl.Name)
+	return hashErr
+}
+
+// patchFile returns the patched contents of fullPath, if the local file is the
+// source of the entry's patch and the result matches the entry's MD5.
+func (list *fileListYaml) patchFile(fullPath string, dl fileEntry) ([]byte, error) {
+	old, err := readStorageFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if md5OfData(old) != dl.Patch.SourceMD5 {
+		return nil, fmt.Errorf("local file does not match patch source")
+	}
+	patch, err := list.fetchFile(dl.Patch.Name, list.DownloadPrefix+dl.Patch.Name, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	data, err := bspatch(old, patch, maxDownloadSize(dl))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMD5(data, dl.MD5); err != nil {
+		return nil, fmt.Errorf("patched file: %w", err)
+	}
+	return data, nil
+}
+
+// maxDownloadSize returns the most bytes a patch or decompression may produce
+// for dl, its Size when known.
+func maxDownloadSize(dl fileEntry) int64 {
+	if dl.Size == 0 && dl.MD5 != emptyMD5 {
+		// the size isn't known, so only refuse implausible ones
+		return maxPlausibleSize
+	}
+	return int64(dl.Size)
+}
+
+// downloadURL returns the URL of dl, which is below the manifest's download
+// prefix unless the entry specifies its own. Compressed files have the
+// extension of their compression appended.
+func (list *fileListYaml) downloadURL(dl fileEntry) string {
+	if dl.URL != "" {
+		return dl.URL
+	}
+	if dl.Compression == compressionZstd {
+		return list.DownloadPrefix + dl.Name + ".zst"
+	}
+	return list.DownloadPrefix + dl.Name
+}
+
+// fetchFile returns the contents of name from --source-dir if set, or from
+// fileURL. With --mirror, files below the download prefix are fetched from
+// the healthiest mirror, trying the others if that fails. size is the
+// expected size if known, or 0. compressed is set when size is that of the
+// decompressed file, which can then not be fetched in segments.
+func (list *fileListYaml) fetchFile(name, fileURL string, size uint, compressed bool) ([]byte, error) {
+	if arg.SourceDir != "" {
+		fullPath := filepath.Join(arg.SourceDir, name)
+		reporter.Logf("COPY %s", fullPath)
+		return os.ReadFile(fullPath)
+	}
+	if list.mirrors == nil || !strings.HasPrefix(fileURL, list.DownloadPrefix) {
+		return fetchFromURL(name, fileURL, size, compressed)
+	}
+	rel := strings.TrimPrefix(fileURL, list.DownloadPrefix)
+	tried := map[string]bool{}
+	var lastErr error
+	for prefix := list.mirrors.pick(tried); prefix != ""; prefix = list.mirrors.pick(tried) {
+		data, err := fetchFromURL(name, prefix+rel, size, compressed)
+		if cancelled() {
+			return nil, err
+		}
+		list.mirrors.record(prefix, err)
+		if err == nil {
+			return data, nil
+		}
+		tried[prefix] = true
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func fetchFromURL(name, fileURL string, size uint, compressed bool) ([]byte, error) {
+	reporter.Logf("GET %s", fileURL)
+	if arg.Segments > 1 && size >= segmentMinSize && !compressed {
+		data, err := fetchSegmented(fileURL, int64(size), arg.Segments)
+		if err != errRangesUnsupported {
+			return data, err
 		}
+		reporter.Logf("- Server does not support ranges, downloading %s in one piece", name)
 	}
-	fmt.Printf("- %d files downloaded\n", downloadCount)
+	var data []byte
+	err := withRetry(fileURL, func() (err error) {
+		data, _, err = fetchUrlWithType(fileURL, fileTimeout(int64(size)))
+		return err
+	})
+	return data, err
+}
+
+func verifyWrittenFiles(rootPath string, written []fileEntry, report *runReport) {
+	fmt.Fprintf(stdout, "Verifying %d written files ...\n", len(written))
+	failCount := 0
+	for _, dl := range written {
+		actualMD5, _, err := storage.Hash(filepath.Join(rootPath, dl.Name))
+		if err != nil {
+			fmt.Fprintln(stdout, "- Verify failed:", dl.Name, err)
+			report.addFailure(dl.Name, failFilesystem, err)
+			failCount++
+			continue
+		}
+		if actualMD5 != dl.MD5 {
+			err := fmt.Errorf("after writing: %w", &hashMismatchError{Expected: dl.MD5, Actual: actualMD5})
+			fmt.Fprintln(stdout, "- Verify failed:", dl.Name, err)
+			report.addFailure(dl.Name, failFilesystem, err)
+			failCount++
+		}
+	}
+	fmt.Fprintf(stdout, "- %d files failed verification\n", failCount)
 }
 
 func DownloadFileList(clientName, expansion string) (*fileListYaml, error) {
 
-	filelistName := "filelist_" + arg.Client + "." + arg.Expansion + ".yml"
-	filelistFullPath := filepath.Join(getSettingsRoot(), filelistName)
-	filelistURL := "https://" + arg.Expansion + ".fvproject.com/" + arg.Client + "/filelist_" + arg.Client + ".yml"
+	filelistURL := manifestURL(clientName, expansion)
+	filelistFullPath := filepath.Join(getSettingsRoot(), manifestCacheName(clientName, expansion, filelistURL))
+	if arg.SourceDir != "" {
+		localFilelist := filepath.Join(arg.SourceDir, "filelist_"+clientName+".yml")
+		if fileOrDirExists(localFilelist) {
+			fmt.Fprintln(stdout, "Filelist is", localFilelist)
+			if publicKey := manifestPublicKey(); publicKey != "" {
+				if err := verifyManifestFile(localFilelist, publicKey); err != nil {
+					return nil, fmt.Errorf("%w. Pass --no-verify-signature to use it anyway", err)
+				}
+			}
+			return readFileList(localFilelist)
+		}
+	}
 
-	fmt.Println("Filelist URL is", filelistURL)
+	fmt.Fprintln(stdout, "Filelist URL is", filelistURL)
 
-	if !fileOrDirExists(filelistFullPath) || isCachedFileTooOld(filelistFullPath, 7) {
-		fmt.Println("GET", filelistURL, "...")
-		data, err := fetchUrl(filelistURL)
+	defer lockManifestCache(filelistFullPath)()
+	publicKey := manifestPublicKey()
+	refresh := arg.RefreshManifest || !fileOrDirExists(filelistFullPath) || isCachedFileTooOld(filelistFullPath, 7)
+	if !refresh && publicKey != "" && verifyManifestFile(filelistFullPath, publicKey) != nil {
+		// cached before a key was configured, or signed with another one
+		fmt.Fprintln(stdout, "Cached filelist is not signed with the public key, fetching it again")
+		refresh = true
+	}
+	if refresh {
+		fmt.Fprintln(stdout, "GET", filelistURL, "...")
+		data, err := fetchManifestWithRetry(filelistURL)
 		if err != nil {
+			if !arg.AllowStale || !fileOrDirExists(filelistFullPath) {
+				return nil, err
+			}
+			if publicKey != "" {
+				if sigErr := verifyManifestFile(filelistFullPath, publicKey); sigErr != nil {
+					return nil, fmt.Errorf("%w, and the stale cached copy can't be used: %v", err, sigErr)
+				}
+			}
+			fmt.Fprintln(stdout, "WARNING: could not refresh filelist, using stale cached copy:", err)
+			return readFileList(filelistFullPath)
+		}
+		var sig []byte
+		if publicKey != "" {
+			if sig, err = verifyManifestSignature(filelistURL, data, publicKey); err != nil {
+				return nil, fmt.Errorf("%w. Pass --no-verify-signature to use it anyway", err)
+			}
+		}
+		if err := mkdirAll(getSettingsRoot()); err != nil {
 			return nil, err
 		}
-		if err := os.MkdirAll(getSettingsRoot(), 0777); err != nil {
+		if err := replaceFile(filelistFullPath, data); err != nil {
 			return nil, err
 		}
-		if err := writeFile(filelistFullPath, data); err != nil {
+		// kept next to the cached copy, so it can be verified when reused
+		if sig == nil {
+			os.Remove(filelistFullPath + ".minisig")
+		} else if err := replaceFile(filelistFullPath+".minisig", sig); err != nil {
 			return nil, err
 		}
 	}
 
-	data, err := os.ReadFile(filelistName)
+	return readFileList(filelistFullPath)
+}
+
+// manifestLocks holds a mutex per cached filelist path, as roots patched with
+// --parallel-roots may share one.
+var manifestLocks sync.Map
+
+// lockManifestCache locks the cached filelist at path, returning the unlock
+// function.
+func lockManifestCache(path string) func() {
+	mu, _ := manifestLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func readFileList(fileName string) (*fileListYaml, error) {
+	data, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, err
 	}
 
 	var list fileListYaml
-	err = yaml.Unmarshal(data, &list)
-	return &list, err
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.SchemaVersion > filelistSchemaVersion {
+		return nil, fmt.Errorf("filelist uses schema version %d, but this fvpatcher only understands up to version %d. Please upgrade with: go install github.com/martinlindhe/fvpatcher@latest", list.SchemaVersion, filelistSchemaVersion)
+	}
+	list.normalizeHashes()
+	return &list, nil
+}
+
+// normalizeHashes trims and lowercases the manifest's MD5 values, so they
+// compare equal to the hashes we compute.
+func (list *fileListYaml) normalizeHashes() {
+	for i := range list.Deletes {
+		list.Deletes[i].MD5 = normalizeMD5(list.Deletes[i].MD5)
+	}
+	for i := range list.Downloads {
+		dl := &list.Downloads[i]
+		dl.MD5 = normalizeMD5(dl.MD5)
+		if dl.Patch != nil {
+			dl.Patch.SourceMD5 = normalizeMD5(dl.Patch.SourceMD5)
+		}
+	}
+}
+
+func normalizeMD5(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+func manifestURL(clientName, expansion string) string {
+	if arg.ManifestURL != "" {
+		return arg.ManifestURL
+	}
+	return "https://" + expansion + ".fvproject.com/" + clientName + "/filelist_" + clientName + ".yml"
+}
+
+// manifestCacheName includes a hash of the manifest URL so that mirrors or
+// overrides for the same client and expansion don't share a cache file.
+func manifestCacheName(clientName, expansion, filelistURL string) string {
+	return "filelist_" + clientName + "." + expansion + "." + md5OfData([]byte(filelistURL))[:8] + ".yml"
 }
 
 func md5OfData(data []byte) string {
@@ -133,12 +1097,22 @@ func md5OfData(data []byte) string {
 }
 
 func md5OfFile(fileName string) (string, error) {
+	if hashOpenFiles != nil {
+		hashOpenFiles <- struct{}{}
+		defer func() { <-hashOpenFiles }()
+	}
 	f, err := os.Open(fileName)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
+	if arg.MMap {
+		if sum, err := md5OfFileMmap(f); err == nil {
+			return sum, nil
+		}
+	}
+
 	h := md5.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
@@ -146,23 +1120,154 @@ func md5OfFile(fileName string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// octalMode is a file mode flag given in octal notation.
+type octalMode os.FileMode
+
+func (m *octalMode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid octal mode %q", text)
+	}
+	if v&^uint64(os.ModePerm) != 0 {
+		return fmt.Errorf("mode %q has bits outside of 0777", text)
+	}
+	*m = octalMode(v)
+	return nil
+}
+
+func (m octalMode) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%04o", uint32(m))), nil
+}
+
+// byteSize is a size flag in bytes, optionally with a K, M or G suffix
+// (powers of 1024), such as 500M.
+type byteSize uint64
+
+func (s *byteSize) UnmarshalText(text []byte) error {
+	str := strings.ToUpper(strings.TrimSpace(string(text)))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	multiplier := uint64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte("KMG", str[n-1]); i >= 0 {
+			multiplier = 1 << (10 * (i + 1))
+			str = str[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	*s = byteSize(v * multiplier)
+	return nil
+}
+
+func (s byteSize) MarshalText() ([]byte, error) {
+	return []byte(formatBytes(int64(s))), nil
+}
+
+// newest filelist schema version understood. Filelists without a
+// SchemaVersion are version 1.
+const filelistSchemaVersion = 1
+
 type fileListYaml struct {
+	// SchemaVersion is raised when the filelist format changes in a way older
+	// tools can't handle.
+	SchemaVersion int `yaml:",omitempty"`
+
 	Version        string
 	Deletes        []fileEntry
 	DownloadPrefix string
 	Downloads      []fileEntry
+
+	// Bundle is an optional zip file below DownloadPrefix holding the
+	// downloads, to fetch many files in a single request.
+	Bundle string `yaml:",omitempty"`
+
+	// TotalFiles and TotalSize optionally declare the number and total size
+	// of the downloads, checked against the install after a run.
+	TotalFiles int    `yaml:",omitempty"`
+	TotalSize  uint64 `yaml:",omitempty"`
+
+	// expansion and client the manifest was loaded for
+	expansion, client string
+
+	// exclude patterns in effect for the root
+	excludes []string
+
+	// downloads before any filtering
+	allDownloads []fileEntry
+
+	// health of the download prefix and mirrors, if any
+	mirrors *mirrorHealth
+
+	// per-run dir below --tmp-dir downloads are staged in, if any
+	stagingDir string
 }
 
 type fileEntry struct {
 	Name string
-	MD5  string
-	Date string
-	Size uint
+
+	// MD5 is optional for delete entries, which then only delete the file if
+	// it still matches.
+	MD5   string     `yaml:",omitempty"`
+	Date  string     `yaml:",omitempty"`
+	Size  uint       `yaml:",omitempty"`
+	Patch *filePatch `yaml:",omitempty"`
+
+	// URL is an optional absolute URL of the file, for files not hosted
+	// below DownloadPrefix.
+	URL string `yaml:",omitempty"`
+
+	// Compression is "zstd" for files stored compressed on the server, at
+	// Name with .zst appended. MD5 and Size describe the decompressed file.
+	Compression string `yaml:",omitempty"`
+
+	// Glob marks a delete entry whose Name is a path.Match pattern, deleting
+	// all matching files and directory trees under the root.
+	Glob bool `yaml:",omitempty"`
 }
 
+// filePatch is a bsdiff patch turning the local file with SourceMD5 into the
+// file described by the owning fileEntry.
+type filePatch struct {
+	Name      string
+	SourceMD5 string
+}
+
+var (
+	settingsRoot     string
+	settingsRootOnce sync.Once
+)
+
+// getSettingsRoot returns ~/.config/fvpatcher, or a folder in the temp dir
+// if that one isn't writable.
 func getSettingsRoot() string {
-	homeDir, _ := os.UserHomeDir()
-	return filepath.Join(homeDir, ".config/fvpatcher")
+	settingsRootOnce.Do(func() {
+		homeDir, _ := os.UserHomeDir()
+		settingsRoot = filepath.Join(homeDir, ".config/fvpatcher")
+		if arg.SettingsDir != "" {
+			settingsRoot = arg.SettingsDir
+		}
+		if err := checkWritableDir(settingsRoot); err != nil {
+			fallback := filepath.Join(os.TempDir(), "fvpatcher")
+			fmt.Fprintln(stdout, "WARNING: settings dir is not writable, using", fallback, "instead:", err)
+			settingsRoot = fallback
+		}
+	})
+	return settingsRoot
+}
+
+// checkWritableDir creates dir if needed and checks that files can be created in it.
+func checkWritableDir(dir string) error {
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 func fileOrDirExists(path string) bool {
@@ -173,29 +1278,199 @@ func fileOrDirExists(path string) bool {
 }
 
 func writeFile(fileName string, data []byte) error {
+	if err := mkdirAll(filepath.Dir(fileName)); err != nil {
+		return err
+	}
 	f, err := os.Create(fileName)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = f.Write(data)
-	return err
+	if arg.FileMode != 0 {
+		if err := f.Chmod(os.FileMode(arg.FileMode)); err != nil {
+			return err
+		}
+	}
+	if err := writeAll(f, data); err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
-func fetchUrl(url string) ([]byte, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// replaceFile writes data to a temporary file next to fileName and renames it
+// over fileName, so readers never see a partly written file.
+func replaceFile(fileName string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", fileName, os.Getpid())
+	if err := writeFile(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: tr}
+	if err := os.Rename(tmp, fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
 
+// writeAll writes data to w, failing on short writes.
+func writeAll(w io.Writer, data []byte) error {
+	n, err := w.Write(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("short write, wrote %d of %d bytes", n, len(data))
+	}
+	return nil
+}
+
+// mkdirAll is os.MkdirAll honoring --dir-mode for the created directories.
+func mkdirAll(path string) error {
+	if arg.DirMode == 0 {
+		return os.MkdirAll(path, 0777)
+	}
+	if fileOrDirExists(path) {
+		return nil
+	}
+	if err := mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(path, os.FileMode(arg.DirMode)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return os.Chmod(path, os.FileMode(arg.DirMode))
+}
+
+var (
+	transport     *http.Transport
+	transportOnce sync.Once
+)
+
+// sharedTransport returns the transport used for all requests, so that
+// connections are reused between downloads. Go's default of 2 idle
+// connections per host would make parallel workers reconnect constantly.
+func sharedTransport() *http.Transport {
+	transportOnce.Do(func() {
+		proxy := http.ProxyFromEnvironment
+		if arg.Proxy != "" {
+			// validated in validateNetworkArgs
+			proxyURL, _ := url.Parse(arg.Proxy)
+			proxy = http.ProxyURL(proxyURL)
+		}
+		dialer := &net.Dialer{Timeout: arg.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport = &http.Transport{
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: arg.InsecureSkipTLSVerify},
+			Proxy:               proxy,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: arg.ConnectTimeout,
+			MaxIdleConns:        arg.MaxIdleConns,
+			MaxIdleConnsPerHost: arg.MaxIdleConnsPerHost,
+			IdleConnTimeout:     arg.IdleConnTimeout,
+		}
+	})
+	return transport
+}
+
+func newHTTPClient() *http.Client {
+	var tr http.RoundTripper = stallTimeoutTransport{sharedTransport(), arg.ReadTimeout}
+	if arg.AllowHTTPFallback {
+		tr = httpFallbackTransport{tr}
+	}
+	if arg.BasicAuth != "" {
+		tr = basicAuthTransport{tr}
+	}
+	return &http.Client{Transport: cancelTransport{tr}}
+}
+
+// basicAuthTransport adds the --basic-auth credentials to each request.
+type basicAuthTransport struct {
+	base http.RoundTripper
+}
+
+func (t basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	user, password, _ := strings.Cut(arg.BasicAuth, ":")
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(user, password)
+	return t.base.RoundTrip(req)
+}
+
+func validateNetworkArgs() error {
+	if arg.Proxy != "" {
+		if u, err := url.Parse(arg.Proxy); err != nil || u.Host == "" {
+			return fmt.Errorf("--proxy: invalid URL %q", arg.Proxy)
+		}
+	}
+	if arg.ConnectTimeout <= 0 {
+		return fmt.Errorf("--connect-timeout must be positive, got %s", arg.ConnectTimeout)
+	}
+	if arg.ReadTimeout <= 0 {
+		return fmt.Errorf("--read-timeout must be positive, got %s", arg.ReadTimeout)
+	}
+	if arg.BasicAuth != "" && !strings.Contains(arg.BasicAuth, ":") {
+		return fmt.Errorf("--basic-auth must be in the form user:password")
+	}
+	return nil
+}
+
+func fetchUrl(url string) ([]byte, error) {
+	data, _, err := fetchUrlWithType(url, 0)
+	return data, err
+}
+
+// fetchUrlWithType returns the body of url along with its Content-Type. The
+// whole request must finish within timeout, if not 0.
+func fetchUrlWithType(url string, timeout time.Duration) ([]byte, string, error) {
+	client := newHTTPClient()
+	client.Timeout = timeout
 	response, err := client.Get(url)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer response.Body.Close()
-	return io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return nil, "", &httpStatusError{"GET", url, response.StatusCode, response.Status}
+	}
+	reporter.FetchStarted(url)
+	defer reporter.FetchDone(url)
+	data, err := io.ReadAll(&progressReader{r: response.Body, url: url})
+	return data, response.Header.Get("Content-Type"), err
+}
+
+// fetchManifestWithRetry fetches the filelist at url, refusing HTML pages
+// such as captive portals or error pages served in its place.
+func fetchManifestWithRetry(url string) ([]byte, error) {
+	var data []byte
+	var contentType string
+	err := withRetry(url, func() (err error) {
+		data, contentType, err = fetchUrlWithType(url, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" || (mediaType == "" && looksLikeHTML(data)) {
+		return nil, fmt.Errorf("%s returned a web page (%s) instead of a filelist, maybe a captive portal or an error page", url, contentType)
+	}
+	return data, nil
+}
+
+// progressReader reports the bytes read from r to the reporter.
+type progressReader struct {
+	r   io.Reader
+	url string
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		receivedBytes.Add(int64(n))
+		reporter.FetchProgress(p.url, n)
+	}
+	return n, err
 }
 
 func isCachedFileTooOld(fileName string, maxDays int) bool {
@@ -0,0 +1,935 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// testOutput collects what a test prints, which may come from several
+// goroutines.
+type testOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *testOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *testOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// setupTest sets the global arg from args as if given on the command line,
+// sends the output to the returned buffer and keeps the settings in a temp
+// dir. Everything is restored when the test ends.
+func setupTest(t *testing.T, args ...string) *testOutput {
+	t.Helper()
+	savedArg, savedStdout, savedStorage, savedReporter := arg, stdout, storage, reporter
+	savedSettingsRoot, savedHostLimits, savedOpenFiles := settingsRoot, hostLimits, hashOpenFiles
+	savedExcludes, savedCtx, savedCancel := excludePatterns, runCtx, cancelRun
+	t.Cleanup(func() {
+		arg, stdout, storage, reporter = savedArg, savedStdout, savedStorage, savedReporter
+		settingsRoot, hostLimits, hashOpenFiles = savedSettingsRoot, savedHostLimits, savedOpenFiles
+		excludePatterns, runCtx, cancelRun = savedExcludes, savedCtx, savedCancel
+		transportOnce = sync.Once{}
+		resetRunState()
+	})
+
+	reflect.ValueOf(&arg).Elem().Set(reflect.Zero(reflect.TypeOf(arg)))
+	parser, err := kong.New(&arg, kong.Exit(func(int) { t.Fatalf("invalid arguments %q", args) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Parse(args); err != nil {
+		t.Fatalf("parsing %q: %v", args, err)
+	}
+
+	settingsRootOnce.Do(func() {})
+	settingsRoot = t.TempDir()
+	out := &testOutput{}
+	stdout = out
+	storage = osStorage{}
+	reporter = plainReporter{}
+	hostLimits = newHostLimiter(arg.ConcurrencyPerHost)
+	hashOpenFiles = nil
+	if arg.MaxOpenFiles > 0 {
+		hashOpenFiles = make(chan struct{}, arg.MaxOpenFiles)
+	}
+	excludePatterns = arg.Exclude
+	if arg.ExcludeFrom != "" {
+		patterns, err := loadExcludeFile(arg.ExcludeFrom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		excludePatterns = append(excludePatterns, patterns...)
+	}
+	runCtx, cancelRun = context.WithCancel(context.Background())
+	transportOnce = sync.Once{}
+	resetRunState()
+	return out
+}
+
+// md5Hex returns the MD5 of s as the filelists have it.
+func md5Hex(s string) string {
+	return md5OfData([]byte(s))
+}
+
+// writeTestFiles creates files, a map of slash separated names to content,
+// below rootPath.
+func writeTestFiles(t *testing.T, rootPath string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fullPath := filepath.Join(rootPath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestFile returns the content of name below rootPath, or "<missing>".
+func readTestFile(t *testing.T, rootPath, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(rootPath, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestVerifyWrittenFilesDetectsCorruption(t *testing.T) {
+	setupTest(t, "--verify-after")
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"good.txt": "good", "bad.txt": "corrupted on disk"})
+	written := []fileEntry{
+		{Name: "good.txt", MD5: md5Hex("good")},
+		{Name: "bad.txt", MD5: md5Hex("as downloaded")},
+	}
+	report := newRunReport(rootPath, "1")
+	verifyWrittenFiles(rootPath, written, report)
+
+	if len(report.Failed) != 1 || report.Failed[0].Name != "bad.txt" || report.Failed[0].Category != failFilesystem {
+		t.Fatalf("failed = %+v, want only bad.txt as a filesystem error", report.Failed)
+	}
+}
+
+// testServer serves a filelist at /filelist.yml and its downloads below
+// /files/, counting the requests per path.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	list     fileListYaml
+	files    map[string][]byte
+	requests map[string]int
+
+	// sign returns the signature served at /filelist.yml.minisig, if set
+	sign func(data []byte) []byte
+}
+
+// newTestServer returns a server whose filelist has version 1 and a
+// download for each of files, a map of names to content.
+func newTestServer(t *testing.T, files map[string]string) *testServer {
+	t.Helper()
+	srv := &testServer{files: map[string][]byte{}, requests: map[string]int{}}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	t.Cleanup(srv.Close)
+	srv.list = fileListYaml{Version: "1", DownloadPrefix: srv.URL + "/files/", Deletes: []fileEntry{}}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srv.files[name] = []byte(files[name])
+		srv.list.Downloads = append(srv.list.Downloads, fileEntry{Name: name, MD5: md5Hex(files[name]), Size: uint(len(files[name]))})
+	}
+	return srv
+}
+
+func (srv *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	srv.requests[r.URL.Path]++
+	var data []byte
+	var ok bool
+	if r.URL.Path == "/filelist.yml" {
+		data, _ = yaml.Marshal(&srv.list)
+		ok = true
+	} else if r.URL.Path == "/filelist.yml.minisig" && srv.sign != nil {
+		data, _ = yaml.Marshal(&srv.list)
+		data, ok = srv.sign(data), true
+	} else if name := strings.TrimPrefix(r.URL.Path, "/files/"); name != r.URL.Path {
+		data, ok = srv.files[name]
+	}
+	srv.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(data))
+}
+
+// update changes the filelist or files served.
+func (srv *testServer) update(fn func(list *fileListYaml, files map[string][]byte)) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	fn(&srv.list, srv.files)
+}
+
+// requestCount returns how often path was requested.
+func (srv *testServer) requestCount(path string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests[path]
+}
+
+// patchArgs returns the arguments patching rootPath with the filelist of
+// srv, followed by extra.
+func (srv *testServer) patchArgs(rootPath string, extra ...string) []string {
+	return append([]string{"patch", rootPath, "--manifest-url", srv.URL + "/filelist.yml",
+		"--client", "rof", "--expansion", "original", "--retry-base-delay", "1ms", "--retry-max-delay", "1ms"}, extra...)
+}
+
+func TestManifestCacheNameDiffersPerURL(t *testing.T) {
+	a := manifestCacheName("rof", "original", "https://original.fvproject.com/rof/filelist_rof.yml")
+	b := manifestCacheName("rof", "original", "https://mirror.example.com/rof/filelist_rof.yml")
+	if a == b {
+		t.Errorf("both URLs are cached as %s", a)
+	}
+	if again := manifestCacheName("rof", "original", "https://original.fvproject.com/rof/filelist_rof.yml"); again != a {
+		t.Errorf("the same URL is cached as %s and %s", a, again)
+	}
+}
+
+func TestDownloadFileListCachesURLsSeparately(t *testing.T) {
+	first := newTestServer(t, map[string]string{"a.txt": "a"})
+	second := newTestServer(t, map[string]string{"b.txt": "b"})
+	second.update(func(list *fileListYaml, _ map[string][]byte) { list.Version = "2" })
+	setupTest(t, first.patchArgs(t.TempDir())...)
+
+	for _, srv := range []*testServer{first, second} {
+		arg.ManifestURL = srv.URL + "/filelist.yml"
+		if _, err := DownloadFileList("rof", "original"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, srv := range []*testServer{first, second} {
+		cachePath := filepath.Join(settingsRoot, manifestCacheName("rof", "original", srv.URL+"/filelist.yml"))
+		list, err := readFileList(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Version != srv.list.Version {
+			t.Errorf("%s has version %s, want %s", cachePath, list.Version, srv.list.Version)
+		}
+	}
+}
+
+func TestWrittenFilesHonorModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions on windows")
+	}
+	for _, extra := range [][]string{nil, {"--tmp-dir", t.TempDir()}} {
+		srv := newTestServer(t, map[string]string{"top.txt": "top", "sub/dir/file.txt": "nested"})
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath, append([]string{"--file-mode", "0640", "--dir-mode", "0750"}, extra...)...)...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Failed) != 0 {
+			t.Fatalf("failed = %+v", report.Failed)
+		}
+		for name, want := range map[string]os.FileMode{"top.txt": 0640, "sub/dir/file.txt": 0640, "sub": 0750, "sub/dir": 0750} {
+			info, err := os.Stat(filepath.Join(rootPath, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != want {
+				t.Errorf("%s with %q has mode %04o, want %04o", name, extra, got, want)
+			}
+		}
+	}
+}
+
+func TestOctalMode(t *testing.T) {
+	tests := []struct {
+		text string
+		want octalMode
+		ok   bool
+	}{
+		{"0644", 0644, true},
+		{"755", 0755, true},
+		{"0999", 0, false},
+		{"01777", 0, false},
+		{"rw-r--r--", 0, false},
+	}
+	for _, tt := range tests {
+		var m octalMode
+		err := m.UnmarshalText([]byte(tt.text))
+		if (err == nil) != tt.ok || m != tt.want {
+			t.Errorf("UnmarshalText(%q) = %04o, %v, want %04o, ok %v", tt.text, m, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDownloadCreatesSubdirectories(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"maps/new/zone.eqg": "zone", "resources/empty.txt": ""})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	if got := readTestFile(t, rootPath, "maps/new/zone.eqg"); got != "zone" {
+		t.Errorf("maps/new/zone.eqg = %q", got)
+	}
+	if got := readTestFile(t, rootPath, "resources/empty.txt"); got != "" {
+		t.Errorf("resources/empty.txt = %q", got)
+	}
+}
+
+func TestRootIsNormalized(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	parent, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPath := filepath.Join(parent, "eq")
+	if err := os.Mkdir(rootPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(parent); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	typed := []string{"eq", "eq" + string(filepath.Separator), filepath.Join(".", "eq", "..", "eq"), rootPath + string(filepath.Separator)}
+	if err := os.Symlink(rootPath, filepath.Join(parent, "link")); err == nil {
+		typed = append(typed, "link")
+	}
+
+	for _, root := range typed {
+		if got, err := normalizeRoot(root); err != nil || got != rootPath {
+			t.Errorf("normalizeRoot(%q) = %q, %v, want %s", root, got, err, rootPath)
+		}
+	}
+	out := setupTest(t, srv.patchArgs("eq")...)
+	roots, err := normalizeRoots(typed)
+	if err != nil || len(roots) != 1 || roots[0] != rootPath {
+		t.Fatalf("normalizeRoots(%q) = %q, %v, want only %s", typed, roots, err, rootPath)
+	}
+	if n := strings.Count(out.String(), "given more than once"); n != len(typed)-1 {
+		t.Errorf("%d roots ignored, want %d:\n%s", n, len(typed)-1, out)
+	}
+
+	// however it was typed, the same folder is patched
+	report, err := patchRoot(roots[0], time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Root != rootPath || readTestFile(t, rootPath, "a.txt") != "a" {
+		t.Errorf("patched %s, want %s", report.Root, rootPath)
+	}
+}
+
+func TestZeroByteFiles(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"empty.txt": "", "truncated.txt": "", "a.txt": "a"})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"truncated.txt": "not empty"})
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	for _, name := range []string{"empty.txt", "truncated.txt"} {
+		if got := readTestFile(t, rootPath, name); got != "" {
+			t.Errorf("%s = %q, want it empty", name, got)
+		}
+		if n := srv.requests["/files/"+name]; n != 0 {
+			t.Errorf("%s was requested %d times, want it created without downloading", name, n)
+		}
+	}
+
+	// empty files are current on the next run
+	report, err = patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != 0 {
+		t.Errorf("downloaded %q, want empty files left alone", report.Downloaded)
+	}
+}
+
+// shortWriter accepts at most n bytes per write, without an error.
+type shortWriter struct{ n int }
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return w.n, nil
+	}
+	return len(p), nil
+}
+
+func TestWriteAllDetectsShortWrites(t *testing.T) {
+	if err := writeAll(shortWriter{n: 3}, []byte("0123456789")); err == nil || !strings.Contains(err.Error(), "wrote 3 of 10 bytes") {
+		t.Errorf("writeAll() = %v, want a short write error", err)
+	}
+	if err := writeAll(shortWriter{n: 10}, []byte("0123456789")); err != nil {
+		t.Errorf("writeAll() = %v", err)
+	}
+}
+
+func TestPaddedUppercaseMD5Matches(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"local.txt": "local", "remote.txt": "remote"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		for i := range list.Downloads {
+			list.Downloads[i].MD5 = " " + strings.ToUpper(list.Downloads[i].MD5) + "  "
+		}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"local.txt": "local"})
+	setupTest(t, srv.patchArgs(rootPath, "--report-unchanged")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	if !reflect.DeepEqual(report.Unchanged, []string{"local.txt"}) || !reflect.DeepEqual(report.Downloaded, []string{"remote.txt"}) {
+		t.Errorf("unchanged = %q, downloaded = %q", report.Unchanged, report.Downloaded)
+	}
+}
+
+func TestApplyFromSourceDir(t *testing.T) {
+	sourceDir := t.TempDir()
+	writeTestFiles(t, sourceDir, map[string]string{"a.txt": "a", "maps/b.eqg": "b", "corrupt.txt": "bit rot"})
+	list := fileListYaml{Version: "3", Deletes: []fileEntry{}, Downloads: []fileEntry{
+		{Name: "a.txt", MD5: md5Hex("a"), Size: 1},
+		{Name: "maps/b.eqg", MD5: md5Hex("b"), Size: 1},
+		{Name: "corrupt.txt", MD5: md5Hex("correct"), Size: 7},
+		{Name: "absent.txt", MD5: md5Hex("absent"), Size: 6},
+	}}
+	data, err := yaml.Marshal(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, sourceDir, map[string]string{"filelist_rof.yml": string(data)})
+	rootPath := t.TempDir()
+	setupTest(t, "patch", rootPath, "--source-dir", sourceDir, "--client", "rof", "--expansion", "original",
+		"--manifest-url", "http://127.0.0.1:1/unreachable.yml", "--retries", "0")
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Version != "3" {
+		t.Errorf("applied version %s, want the filelist of the source dir", report.Version)
+	}
+	if readTestFile(t, rootPath, "a.txt") != "a" || readTestFile(t, rootPath, "maps/b.eqg") != "b" {
+		t.Error("files were not copied from the source dir")
+	}
+	got := map[string]failureCategory{}
+	for _, f := range report.Failed {
+		got[f.Name] = f.Category
+	}
+	want := map[string]failureCategory{"corrupt.txt": failHashMismatch, "absent.txt": failFilesystem}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("failed = %v, want %v", got, want)
+	}
+}
+
+func TestUnwritableSettingsDirFallsBack(t *testing.T) {
+	// a file where the settings dir should be, which even root can't write to
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	writeTestFiles(t, filepath.Dir(blocker), map[string]string{"blocker": ""})
+	t.Setenv("TMPDIR", t.TempDir())
+	out := setupTest(t, "--settings-dir", filepath.Join(blocker, "fvpatcher"))
+	settingsRootOnce = sync.Once{}
+
+	want := filepath.Join(os.TempDir(), "fvpatcher")
+	if got := getSettingsRoot(); got != want {
+		t.Fatalf("getSettingsRoot() = %s, want %s", got, want)
+	}
+	if !strings.Contains(out.String(), "WARNING: settings dir is not writable, using "+want) {
+		t.Errorf("fallback not reported:\n%s", out)
+	}
+	if err := checkWritableDir(want); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatchMultipleRoots(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		srv := newTestServer(t, map[string]string{"a.txt": "a", "maps/b.eqg": "b"})
+		first, second := t.TempDir(), t.TempDir()
+		writeTestFiles(t, second, map[string]string{"a.txt": "old a"})
+		args := srv.patchArgs(first)
+		args = append(args[:2], append([]string{second}, args[2:]...)...)
+		if parallel {
+			args = append(args, "--parallel-roots")
+		}
+		out := setupTest(t, args...)
+
+		reports, failed, changed := patchRoots(arg.Patch.EverquestRoots, time.Time{})
+		if failed || !changed || len(reports) != 2 {
+			t.Fatalf("parallel %v: patchRoots() = %d reports, failed %v, changed %v", parallel, len(reports), failed, changed)
+		}
+		for _, rootPath := range []string{first, second} {
+			if readTestFile(t, rootPath, "a.txt") != "a" || readTestFile(t, rootPath, "maps/b.eqg") != "b" {
+				t.Errorf("parallel %v: %s was not updated", parallel, rootPath)
+			}
+			if !strings.Contains(out.String(), "Summary of "+rootPath) {
+				t.Errorf("parallel %v: no summary of %s", parallel, rootPath)
+			}
+		}
+		// both roots share the cached filelist
+		if n := srv.requestCount("/filelist.yml"); n != 1 {
+			t.Errorf("fetched the filelist %d times", n)
+		}
+	}
+}
+
+func TestStaleCacheUsedWhenServerFails(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+	settings := settingsRoot
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusInternalServerError)
+	})
+
+	tests := []struct {
+		extra []string
+		ok    bool
+	}{
+		{[]string{"--refresh-manifest"}, true},
+		{[]string{"--refresh-manifest", "--no-allow-stale"}, false},
+	}
+	for _, tt := range tests {
+		out := setupTest(t, srv.patchArgs(rootPath, append([]string{"--retries", "0"}, tt.extra...)...)...)
+		settingsRoot = settings
+		list, err := DownloadFileList("rof", "original")
+		if (err == nil) != tt.ok {
+			t.Fatalf("with %q: DownloadFileList() = %v, want ok %v", tt.extra, err, tt.ok)
+		}
+		if tt.ok && (list.Version != "1" || !strings.Contains(out.String(), "WARNING: could not refresh filelist, using stale cached copy")) {
+			t.Errorf("with %q: got version %s, output:\n%s", tt.extra, list.Version, out)
+		}
+	}
+
+	// without a cached copy there is nothing to fall back to
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	if _, err := DownloadFileList("rof", "original"); err == nil {
+		t.Error("DownloadFileList() without a cached copy succeeded")
+	}
+}
+
+func TestExpectVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		ok      bool
+	}{
+		{"1", true},
+		{"2", false},
+	}
+	for _, tt := range tests {
+		srv := newTestServer(t, map[string]string{"a.txt": "a"})
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath, "--expect-version", tt.version)...)
+
+		_, err := patchRoot(rootPath, time.Time{})
+		if (err == nil) != tt.ok {
+			t.Fatalf("--expect-version %s: patchRoot() = %v, want ok %v", tt.version, err, tt.ok)
+		}
+		want := "a"
+		if !tt.ok {
+			want = "<missing>"
+		}
+		if got := readTestFile(t, rootPath, "a.txt"); got != want {
+			t.Errorf("--expect-version %s: a.txt = %q, want %q", tt.version, got, want)
+		}
+	}
+}
+
+func TestTransportConfiguredFromFlags(t *testing.T) {
+	setupTest(t)
+	tr := sharedTransport()
+	if tr.MaxIdleConns != 100 || tr.MaxIdleConnsPerHost != 16 || tr.IdleConnTimeout != 90*time.Second {
+		t.Errorf("defaults: MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %s",
+			tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	setupTest(t, "--max-idle-conns", "7", "--max-idle-conns-per-host", "3", "--idle-conn-timeout", "5s", "--connect-timeout", "2s")
+	tr = sharedTransport()
+	if tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 3 || tr.IdleConnTimeout != 5*time.Second || tr.TLSHandshakeTimeout != 2*time.Second {
+		t.Errorf("MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %s, TLSHandshakeTimeout %s",
+			tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.TLSHandshakeTimeout)
+	}
+	if sharedTransport() != tr {
+		t.Error("the transport is not shared")
+	}
+}
+
+func TestTLSCertificatesAreVerified(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	setupTest(t)
+	if resp, err := newHTTPClient().Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("accepted the self-signed certificate of the test server")
+	}
+
+	setupTest(t, "--insecure-skip-tls-verify")
+	resp, err := newHTTPClient().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("with --insecure-skip-tls-verify: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestEntryWithDirectURL(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	other := newTestServer(t, map[string]string{"elsewhere/b.eqg": "b"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Downloads = append(list.Downloads,
+			fileEntry{Name: "maps/b.eqg", MD5: md5Hex("b"), Size: 1, URL: other.URL + "/files/elsewhere/b.eqg"},
+			fileEntry{Name: "maps/c.eqg", MD5: md5Hex("c"), Size: 1, URL: other.URL + "/files/elsewhere/b.eqg"})
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, rootPath, "a.txt") != "a" || readTestFile(t, rootPath, "maps/b.eqg") != "b" {
+		t.Error("files were not downloaded from their URLs")
+	}
+	if srv.requestCount("/files/maps/b.eqg") != 0 || other.requestCount("/files/elsewhere/b.eqg") != 2 {
+		t.Error("maps/b.eqg and maps/c.eqg were not fetched from their URLs")
+	}
+	// still verified
+	if len(report.Failed) != 1 || report.Failed[0].Name != "maps/c.eqg" || report.Failed[0].Category != failHashMismatch {
+		t.Errorf("failed = %+v, want maps/c.eqg as a hash mismatch", report.Failed)
+	}
+}
+
+func TestKeepBadDownloads(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "new a"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { files["a.txt"] = []byte("<html>error</html>") })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a"})
+	setupTest(t, srv.patchArgs(rootPath, "--keep-bad-downloads")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Category != failHashMismatch {
+		t.Errorf("failed = %+v, want a.txt as a hash mismatch", report.Failed)
+	}
+	if got := readTestFile(t, rootPath, "a.txt"); got != "old a" {
+		t.Errorf("a.txt = %q, want it untouched", got)
+	}
+	if got := readTestFile(t, rootPath, "a.txt.bad"); got != "<html>error</html>" {
+		t.Errorf("a.txt.bad = %q, want what the server sent", got)
+	}
+}
+
+func TestOutputIsIncremental(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	release := make(chan struct{})
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/a.txt" {
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath)...)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := patchRoot(rootPath, time.Time{})
+		done <- err
+	}()
+
+	// the download is held back, so anything printed so far was not buffered
+	// until the end of the run
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "Processing 1 requests for downloads") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	printed := out.String()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(printed, "Processing 1 requests for downloads") {
+		t.Errorf("nothing printed while the download was running, got %q", printed)
+	}
+	if got := readTestFile(t, rootPath, "a.txt"); got != "a" {
+		t.Errorf("a.txt = %q, want %q", got, "a")
+	}
+}
+
+func TestCleanupOnly(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "new a", "b.txt": "b", "current.txt": "current"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a", "old.txt": "old", "current.txt": "current"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--cleanup-only")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 1 || readTestFile(t, rootPath, "old.txt") != "<missing>" {
+		t.Errorf("deleted = %q, want old.txt removed", report.Deleted)
+	}
+	if len(report.Downloaded) != 0 || readTestFile(t, rootPath, "a.txt") != "old a" || readTestFile(t, rootPath, "b.txt") != "<missing>" {
+		t.Errorf("downloaded = %q, want nothing", report.Downloaded)
+	}
+	if srv.requestCount("/files/a.txt")+srv.requestCount("/files/b.txt") != 0 {
+		t.Error("files were requested")
+	}
+	for _, line := range []string{"Needs download: a.txt", "Needs download: b.txt", "- 2 files need downloading"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output is missing %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out.String(), "Needs download: current.txt") {
+		t.Errorf("current.txt listed as needed:\n%s", out)
+	}
+}
+
+func TestFreshInstall(t *testing.T) {
+	files := map[string]string{"eqgame.exe": "game", "Resources/a.txt": "a", "Resources/sub/b.txt": "b", "empty.txt": ""}
+	srv := newTestServer(t, files)
+	rootPath := filepath.Join(t.TempDir(), "EverQuest")
+	if err := os.Mkdir(rootPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := setupTest(t, srv.patchArgs(rootPath, "--fresh-install")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Errorf("failed = %+v", report.Failed)
+	}
+	for name, content := range files {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	if strings.Contains(out.String(), "not empty") {
+		t.Errorf("warned about an empty folder:\n%s", out)
+	}
+
+	// everything is downloaded again, with a warning
+	out = setupTest(t, srv.patchArgs(rootPath, "--fresh-install")...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount("/files/eqgame.exe"); n != 2 {
+		t.Errorf("eqgame.exe requested %d times, want 2", n)
+	}
+	if !strings.Contains(out.String(), "--fresh-install in a folder that is not empty") {
+		t.Errorf("no warning about a folder that is not empty:\n%s", out)
+	}
+}
+
+func TestVerboseShowsReasons(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"current.txt": "current", "outdated.txt": "new", "missing.txt": "missing"})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"current.txt": "current", "outdated.txt": "old"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--verbose")...)
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"OK current.txt (MD5 matches)",
+		"Outdated outdated.txt (local MD5 is " + md5Hex("old") + ")",
+		"Missing missing.txt",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("output is missing %q:\n%s", line, out)
+		}
+	}
+
+	out = setupTest(t, srv.patchArgs(rootPath, "--verbose", "--fresh-install")...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Downloading all files, forced by --fresh-install") {
+		t.Errorf("forced download not explained:\n%s", out)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	for _, version := range []int{0, filelistSchemaVersion, filelistSchemaVersion + 1} {
+		srv := newTestServer(t, map[string]string{"a.txt": "a"})
+		srv.update(func(list *fileListYaml, _ map[string][]byte) { list.SchemaVersion = version })
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath)...)
+
+		_, err := patchRoot(rootPath, time.Time{})
+		supported := version <= filelistSchemaVersion
+		if supported && err != nil {
+			t.Errorf("schema version %d: %v", version, err)
+		}
+		if !supported && (err == nil || !strings.Contains(err.Error(), "Please upgrade")) {
+			t.Errorf("schema version %d: got %v, want an error with an upgrade hint", version, err)
+		}
+		if got, want := readTestFile(t, rootPath, "a.txt") == "a", supported; got != want {
+			t.Errorf("schema version %d: a.txt downloaded %v, want %v", version, got, want)
+		}
+	}
+}
+
+// hashCountingStorage counts the files hashed.
+type hashCountingStorage struct {
+	osStorage
+	hashed *atomic.Int64
+}
+
+func (s hashCountingStorage) Hash(fileName string) (string, int64, error) {
+	s.hashed.Add(1)
+	return s.osStorage.Hash(fileName)
+}
+
+func TestAssumeRootClean(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	settings := settingsRoot
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "changed"})
+	if err := os.Remove(filepath.Join(rootPath, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// assumeClean patches rootPath with --assume-root-clean, returning the
+	// output and the number of files hashed
+	assumeClean := func() (string, int64) {
+		out := setupTest(t, srv.patchArgs(rootPath, "--assume-root-clean", "--refresh-manifest")...)
+		settingsRoot = settings
+		var hashed atomic.Int64
+		storage = hashCountingStorage{hashed: &hashed}
+		if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		return out.String(), hashed.Load()
+	}
+
+	// the same version only gets missing files, without hashing anything
+	out, hashed := assumeClean()
+	if !strings.Contains(out, "Version 1 was applied before, only checking for missing files") || hashed != 0 {
+		t.Errorf("fast path not taken, hashed %d files:\n%s", hashed, out)
+	}
+	if readTestFile(t, rootPath, "a.txt") != "changed" || readTestFile(t, rootPath, "b.txt") != "b" {
+		t.Error("the fast path did not only download the missing file")
+	}
+
+	// a new version checks all files
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Version = "2" })
+	out, hashed = assumeClean()
+	if !strings.Contains(out, "Last applied version was 1, checking all files") || hashed == 0 {
+		t.Errorf("no fallback for a new version, hashed %d files:\n%s", hashed, out)
+	}
+	if readTestFile(t, rootPath, "a.txt") != "a" {
+		t.Error("a.txt was not repaired")
+	}
+
+	// as does an install without a record of the last version
+	if err := os.Remove(installStatePath(rootPath)); err != nil {
+		t.Fatal(err)
+	}
+	out, hashed = assumeClean()
+	if !strings.Contains(out, "No record of the last applied version, checking all files") || hashed == 0 {
+		t.Errorf("no fallback without a record, hashed %d files:\n%s", hashed, out)
+	}
+}
+
+func TestHTMLFilelistIsRejected(t *testing.T) {
+	for _, contentType := range []string{"text/html; charset=utf-8", "application/xhtml+xml", ""} {
+		srv := newTestServer(t, map[string]string{"a.txt": "a"})
+		handler := srv.Config.Handler
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/filelist.yml" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			// set even when empty, so the server doesn't detect one
+			w.Header()["Content-Type"] = []string{contentType}
+			w.Write([]byte("<html><body>Please log in to use the hotel wifi</body></html>"))
+		})
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath)...)
+
+		_, err := DownloadFileList("rof", "original")
+		if err == nil || !strings.Contains(err.Error(), "instead of a filelist") {
+			t.Errorf("content type %q: got %v, want the page rejected", contentType, err)
+		}
+		cachePath, _, _, err := manifestCachePath(rootPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+			t.Errorf("content type %q: the page was cached", contentType)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// bundledManifestPublicKey is the minisign public key the official filelists
+// are signed with. It is set at build time with
+// -ldflags "-X main.bundledManifestPublicKey=...". While it and
+// --manifest-public-key are empty, filelists are not verified.
+var bundledManifestPublicKey = ""
+
+// manifestPublicKey returns the minisign public key filelists must be signed
+// with, or "" if signatures are not checked.
+func manifestPublicKey() string {
+	if arg.NoVerifySignature {
+		return ""
+	}
+	if arg.ManifestPublicKey != "" {
+		return arg.ManifestPublicKey
+	}
+	return bundledManifestPublicKey
+}
+
+// verifyManifestSignature fetches the detached minisign signature of the
+// filelist at filelistURL and checks data against it, returning the
+// signature.
+func verifyManifestSignature(filelistURL string, data []byte, publicKey string) ([]byte, error) {
+	sigURL := filelistURL + ".minisig"
+	fmt.Fprintln(stdout, "GET", sigURL, "...")
+	sig, err := fetchUrlWithRetry(sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching filelist signature: %w", err)
+	}
+	if err := minisignVerify(publicKey, data, sig); err != nil {
+		return nil, fmt.Errorf("filelist signature: %w", err)
+	}
+	fmt.Fprintln(stdout, "Filelist signature is valid")
+	return sig, nil
+}
+
+// verifyManifestFile checks the filelist at fileName against the detached
+// signature next to it, for cached and --source-dir filelists.
+func verifyManifestFile(fileName, publicKey string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(fileName + ".minisig")
+	if err != nil {
+		return fmt.Errorf("filelist signature: %w", err)
+	}
+	if err := minisignVerify(publicKey, data, sig); err != nil {
+		return fmt.Errorf("filelist signature: %w", err)
+	}
+	return nil
+}
+
+// minisignVerify checks that sig, the contents of a .minisig file, is a
+// valid signature of data by publicKey, either the base64 key or the
+// contents of a minisign .pub file.
+func minisignVerify(publicKey string, data, sig []byte) error {
+	key, err := decodeMinisignLine(publicKey, 42)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if string(key[:2]) != "Ed" {
+		return errors.New("invalid public key: unsupported algorithm")
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed signature file")
+	}
+	sigBlob, err := decodeMinisignLine(lines[1], 74)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	globalSig, err := decodeMinisignLine(lines[3], 64)
+	if err != nil {
+		return fmt.Errorf("malformed trusted comment signature: %w", err)
+	}
+	if !bytes.Equal(sigBlob[2:10], key[2:10]) {
+		return fmt.Errorf("signed with key %X, expected key %X", sigBlob[2:10], key[2:10])
+	}
+
+	pk := ed25519.PublicKey(key[10:])
+	signature := sigBlob[10:]
+	switch string(sigBlob[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		data = sum[:]
+	default:
+		return errors.New("unsupported signature algorithm")
+	}
+	if !ed25519.Verify(pk, data, signature) {
+		return errors.New("signature verification failed")
+	}
+	trusted := append(append([]byte{}, signature...), strings.TrimPrefix(lines[2], "trusted comment: ")...)
+	if !ed25519.Verify(pk, trusted, globalSig) {
+		return errors.New("trusted comment verification failed")
+	}
+	return nil
+}
+
+// decodeMinisignLine decodes the last non-comment line of s, which must hold
+// size bytes.
+func decodeMinisignLine(s string, size int) ([]byte, error) {
+	line := ""
+	for _, l := range strings.Split(strings.TrimSpace(s), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("got %d bytes, expected %d", len(b), size)
+	}
+	return b, nil
+}
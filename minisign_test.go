@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a filelist signed by minisign with a prehashed signature
+const (
+	vectorPublicKey = "RWQ6kVwH4kS4Fk0Ow6DQP+//k6m8zioktAbUb0Su/x93h9rtsTyq+kAs"
+	vectorFilelist  = "version: \"1\"\ndownloadprefix: https://cdn.example.com/rof/\n"
+	vectorSignature = "untrusted comment: signature from minisign secret key\n" +
+		"RUQ6kVwH4kS4FuWg8JJJQIV+UV3FrlwPUnvjDNxU84PfXbM96RFRgfq6UTqFDgj77+MGHRuz7P7kF1TDrJGiDAdmEZ6UZTT15AE=\n" +
+		"trusted comment: timestamp:1700000000\tfile:filelist_rof.yml\thashed\n" +
+		"RZhDx1ZNxp+fvz6SPXVxev8fkn8xRPqIl7ERGbSJm+adIbUPkfX2lR0UBQUuXBkqHgiLG7S6TGZDUyGYVpYBCg==\n"
+)
+
+// testSigner signs like minisign -l, with a key derived from seed.
+type testSigner struct {
+	key   ed25519.PrivateKey
+	keyID []byte
+}
+
+func newTestSigner(seed byte) testSigner {
+	return testSigner{
+		key:   ed25519.NewKeyFromSeed(bytesOf(seed, ed25519.SeedSize)),
+		keyID: bytesOf(seed, 8),
+	}
+}
+
+func bytesOf(b byte, n int) []byte {
+	return []byte(strings.Repeat(string([]byte{b}), n))
+}
+
+// publicKey returns the contents of the minisign .pub file.
+func (s testSigner) publicKey() string {
+	key := append(append([]byte("Ed"), s.keyID...), s.key.Public().(ed25519.PublicKey)...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+// sign returns the contents of the .minisig file of data.
+func (s testSigner) sign(data []byte) []byte {
+	sig := ed25519.Sign(s.key, data)
+	trusted := "timestamp:1700000000\tfile:filelist.yml"
+	global := ed25519.Sign(s.key, append(append([]byte{}, sig...), trusted...))
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), s.keyID...), sig...)), trusted,
+		base64.StdEncoding.EncodeToString(global)))
+}
+
+func TestMinisignVerify(t *testing.T) {
+	signer := newTestSigner(1)
+	data := []byte("version: \"2\"\n")
+	tampered := strings.Replace(vectorSignature, "timestamp:1700000000", "timestamp:1800000000", 1)
+	tests := []struct {
+		name      string
+		publicKey string
+		data      string
+		sig       string
+		ok        bool
+	}{
+		{"prehashed", vectorPublicKey, vectorFilelist, vectorSignature, true},
+		{"prehashed with CRLF", vectorPublicKey, vectorFilelist, strings.ReplaceAll(vectorSignature, "\n", "\r\n"), true},
+		{"prehashed, changed data", vectorPublicKey, vectorFilelist + "# more\n", vectorSignature, false},
+		{"changed trusted comment", vectorPublicKey, vectorFilelist, tampered, false},
+		{"legacy", signer.publicKey(), string(data), string(signer.sign(data)), true},
+		{"legacy, changed data", signer.publicKey(), "version: \"3\"\n", string(signer.sign(data)), false},
+		{"other key", newTestSigner(2).publicKey(), string(data), string(signer.sign(data)), false},
+		{"truncated", signer.publicKey(), string(data), string(signer.sign(data))[:100], false},
+		{"invalid key", "RWQ=", string(data), string(signer.sign(data)), false},
+	}
+	for _, tt := range tests {
+		if err := minisignVerify(tt.publicKey, []byte(tt.data), []byte(tt.sig)); (err == nil) != tt.ok {
+			t.Errorf("%s: minisignVerify() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSignedFilelist(t *testing.T) {
+	signer := newTestSigner(1)
+	tests := []struct {
+		name string
+		sign func([]byte) []byte
+		ok   bool
+	}{
+		{"valid", signer.sign, true},
+		{"invalid", newTestSigner(2).sign, false},
+		{"missing", nil, false},
+	}
+	for _, tt := range tests {
+		srv := newTestServer(t, map[string]string{"a.txt": "a"})
+		srv.sign = tt.sign
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath, "--retries", "0", "--manifest-public-key", signer.publicKey())...)
+
+		_, err := DownloadFileList("rof", "original")
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s signature: DownloadFileList() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if !tt.ok {
+			cachePath := filepath.Join(settingsRoot, manifestCacheName("rof", "original", srv.URL+"/filelist.yml"))
+			if fileOrDirExists(cachePath) {
+				t.Errorf("%s signature: the filelist was cached", tt.name)
+			}
+			// unless verification is turned off
+			setupTest(t, srv.patchArgs(rootPath, "--retries", "0", "--manifest-public-key", signer.publicKey(), "--no-verify-signature")...)
+			if _, err := DownloadFileList("rof", "original"); err != nil {
+				t.Errorf("%s signature with --no-verify-signature: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestCachedFilelistIsVerified(t *testing.T) {
+	signer := newTestSigner(1)
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	rootPath := t.TempDir()
+	// cached before a key was configured
+	setupTest(t, srv.patchArgs(rootPath)...)
+	settings := settingsRoot
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.sign = signer.sign
+	out := setupTest(t, srv.patchArgs(rootPath, "--manifest-public-key", signer.publicKey())...)
+	settingsRoot = settings
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Cached filelist is not signed with the public key, fetching it again") ||
+		srv.requestCount("/filelist.yml") != 2 {
+		t.Errorf("the unsigned cached filelist was used:\n%s", out)
+	}
+
+	// the signed copy is reused from the cache
+	setupTest(t, srv.patchArgs(rootPath, "--manifest-public-key", signer.publicKey())...)
+	settingsRoot = settings
+	if _, err := DownloadFileList("rof", "original"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.requestCount("/filelist.yml"); n != 2 {
+		t.Errorf("fetched the filelist %d times, want the signed cached copy to be used", n)
+	}
+}
+
+func TestSourceDirFilelistIsVerified(t *testing.T) {
+	signer := newTestSigner(1)
+	data := []byte("version: \"1\"\n")
+	for _, signed := range []bool{true, false} {
+		sourceDir := t.TempDir()
+		files := map[string]string{"filelist_rof.yml": string(data)}
+		if signed {
+			files["filelist_rof.yml.minisig"] = string(signer.sign(data))
+		}
+		writeTestFiles(t, sourceDir, files)
+		setupTest(t, "patch", t.TempDir(), "--source-dir", sourceDir, "--client", "rof", "--expansion", "original",
+			"--manifest-public-key", signer.publicKey())
+		if _, err := DownloadFileList("rof", "original"); (err == nil) != signed {
+			t.Errorf("signed %v: DownloadFileList() = %v", signed, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// a mirror is taken out of use for mirrorCooldown once at least
+// mirrorMinFailures of its requests failed, and they are the majority
+const (
+	mirrorMinFailures = 3
+	mirrorCooldown    = time.Minute
+)
+
+// mirrorHealth tracks the failures of the download prefixes during a run,
+// to route downloads away from failing mirrors.
+type mirrorHealth struct {
+	prefixes []string
+
+	mu    sync.Mutex
+	stats map[string]*mirrorStats
+}
+
+type mirrorStats struct {
+	requests      int
+	failures      int
+	disabledUntil time.Time
+}
+
+func newMirrorHealth(prefixes []string) *mirrorHealth {
+	h := &mirrorHealth{stats: map[string]*mirrorStats{}}
+	for _, prefix := range prefixes {
+		if _, ok := h.stats[prefix]; !ok {
+			h.prefixes = append(h.prefixes, prefix)
+			h.stats[prefix] = &mirrorStats{}
+		}
+	}
+	return h
+}
+
+// pick returns the prefix to download from next, skipping those in tried:
+// the enabled one with the lowest failure rate, or if all are disabled the
+// first one not tried yet. It returns "" when all were tried.
+func (h *mirrorHealth) pick(tried map[string]bool) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	best, fallback := "", ""
+	bestRate := 0.0
+	for _, prefix := range h.prefixes {
+		if tried[prefix] {
+			continue
+		}
+		if fallback == "" {
+			fallback = prefix
+		}
+		s := h.stats[prefix]
+		if now.Before(s.disabledUntil) {
+			continue
+		}
+		rate := 0.0
+		if s.requests > 0 {
+			rate = float64(s.failures) / float64(s.requests)
+		}
+		if best == "" || rate < bestRate {
+			best, bestRate = prefix, rate
+		}
+	}
+	if best == "" {
+		return fallback
+	}
+	return best
+}
+
+// record counts the result of a download from prefix, disabling the mirror
+// if it fails too often.
+func (h *mirrorHealth) record(prefix string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats[prefix]
+	if s == nil {
+		return
+	}
+	s.requests++
+	if err == nil {
+		return
+	}
+	s.failures++
+	if s.failures >= mirrorMinFailures && s.failures*2 > s.requests && !time.Now().Before(s.disabledUntil) {
+		reporter.Logf("- Mirror %s failed %d of %d downloads, not using it for %s", prefix, s.failures, s.requests, mirrorCooldown)
+		s.disabledUntil = time.Now().Add(mirrorCooldown)
+		s.requests, s.failures = 0, 0
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const speedTestMaxBytes = 1 << 20
+
+type mirrorResult struct {
+	Prefix     string
+	Latency    time.Duration
+	Throughput float64 // bytes per second
+	Err        error
+}
+
+// speedTestMirrors fetches a small file from the manifest's download prefix
+// and from each mirror, returning the results fastest first.
+func (list *fileListYaml) speedTestMirrors(mirrors []string) []mirrorResult {
+	probe := list.speedTestProbe()
+	if probe == nil {
+		return nil
+	}
+	prefixes := append([]string{list.DownloadPrefix}, mirrors...)
+	results := make([]mirrorResult, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		fmt.Fprintln(stdout, "Testing", prefix+probe.Name, "...")
+		results = append(results, speedTest(prefix, prefix+probe.Name))
+	}
+	sortMirrorResults(results)
+	return results
+}
+
+// speedTestProbe returns the largest download entry below speedTestMaxBytes,
+// or the smallest entry if all are bigger.
+func (list *fileListYaml) speedTestProbe() *fileEntry {
+	var probe *fileEntry
+	for i := range list.Downloads {
+		dl := &list.Downloads[i]
+		switch {
+		case dl.MD5 == emptyMD5:
+			// nothing to measure
+		case probe == nil:
+			probe = dl
+		case probe.Size > speedTestMaxBytes && dl.Size < probe.Size:
+			probe = dl
+		case dl.Size <= speedTestMaxBytes && dl.Size > probe.Size:
+			probe = dl
+		}
+	}
+	return probe
+}
+
+func speedTest(prefix, url string) mirrorResult {
+	res := mirrorResult{Prefix: prefix}
+	start := time.Now()
+	response, err := newHTTPClient().Get(url)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer response.Body.Close()
+	res.Latency = time.Since(start)
+	if response.StatusCode != http.StatusOK {
+		res.Err = fmt.Errorf("GET %s: %s", url, response.Status)
+		return res
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(response.Body, speedTestMaxBytes))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		res.Throughput = float64(n) / elapsed
+	}
+	return res
+}
+
+// sortMirrorResults orders working mirrors by throughput, then latency,
+// followed by the failed ones.
+func sortMirrorResults(results []mirrorResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Throughput != b.Throughput {
+			return a.Throughput > b.Throughput
+		}
+		return a.Latency < b.Latency
+	})
+}
+
+func printSpeedTest(results []mirrorResult) {
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(stdout, "- %s: %v\n", res.Prefix, res.Err)
+			continue
+		}
+		fmt.Fprintf(stdout, "- %s: latency %s, %s/s\n", res.Prefix, res.Latency.Round(time.Millisecond), formatBytes(int64(res.Throughput)))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDelayedServer serves content for any path after delay.
+func newDelayedServer(t *testing.T, delay time.Duration, content string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSpeedTestMirrorsOrdersFastestFirst(t *testing.T) {
+	content := "probe content"
+	slow := newDelayedServer(t, 150*time.Millisecond, content)
+	fast := newDelayedServer(t, 0, content)
+	medium := newDelayedServer(t, 50*time.Millisecond, content)
+	broken := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(broken.Close)
+	setupTest(t)
+
+	list := fileListYaml{
+		DownloadPrefix: slow.URL + "/",
+		Downloads:      []fileEntry{{Name: "probe.txt", MD5: md5Hex(content), Size: uint(len(content))}},
+	}
+	results := list.speedTestMirrors([]string{broken.URL + "/", fast.URL + "/", medium.URL + "/"})
+
+	want := []string{fast.URL + "/", medium.URL + "/", slow.URL + "/", broken.URL + "/"}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, res := range results {
+		if res.Prefix != want[i] {
+			t.Errorf("result %d is %s, want %s", i, res.Prefix, want[i])
+		}
+	}
+	if results[3].Err == nil {
+		t.Error("the broken mirror has no error")
+	}
+}
+
+func TestTrafficShiftsAwayFromDegradedMirror(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("file%02d.txt", i)] = fmt.Sprint("content ", i)
+	}
+	srv := newTestServer(t, files)
+	mirror := newTestServer(t, files)
+	// the primary serves the first files, then starts failing
+	var served, failedAfter atomic.Int64
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/files/") && served.Add(1) > 5 {
+			failedAfter.Add(1)
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--workers", "1", "--retries", "0", "--mirror", mirror.URL+"/files/")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || len(report.Downloaded) != 20 {
+		t.Errorf("%d downloaded, failed %+v, want all 20 downloaded", len(report.Downloaded), report.Failed)
+	}
+	fromMirror := 0
+	for name := range files {
+		fromMirror += mirror.requestCount("/files/" + name)
+	}
+	if n := failedAfter.Load(); n > mirrorMinFailures {
+		t.Errorf("the degraded mirror got %d more requests, want it avoided", n)
+	}
+	if fromMirror < 15 {
+		t.Errorf("%d files downloaded from the healthy mirror, want the rest of them", fromMirror)
+	}
+}
+
+func TestMirrorHealthDisablesFailingMirror(t *testing.T) {
+	setupTest(t)
+	h := newMirrorHealth([]string{"https://a.example.com/", "https://b.example.com/"})
+	if got := h.pick(nil); got != "https://a.example.com/" {
+		t.Errorf("pick() = %s, want the first mirror while both are healthy", got)
+	}
+	for i := 0; i < mirrorMinFailures; i++ {
+		h.record("https://a.example.com/", errors.New("connection reset"))
+	}
+	h.record("https://b.example.com/", errors.New("connection reset"))
+	h.record("https://b.example.com/", nil)
+	h.record("https://b.example.com/", nil)
+	if got := h.pick(nil); got != "https://b.example.com/" {
+		t.Errorf("pick() = %s, want the healthy mirror", got)
+	}
+	// a disabled mirror is still used when all others were tried
+	if got := h.pick(map[string]bool{"https://b.example.com/": true}); got != "https://a.example.com/" {
+		t.Errorf("pick() = %s, want the disabled mirror as a last resort", got)
+	}
+	if got := h.pick(map[string]bool{"https://a.example.com/": true, "https://b.example.com/": true}); got != "" {
+		t.Errorf("pick() = %s, want none after trying all", got)
+	}
+}
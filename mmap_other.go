@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnsupported
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// httpStatusError is returned when a server answers with an unexpected
+// status.
+type httpStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// httpFallbackTransport retries requests over plain HTTP when connecting
+// over HTTPS fails, for --allow-http-fallback. Requests with credentials are
+// never retried, so they aren't sent in plain text.
+type httpFallbackTransport struct {
+	base http.RoundTripper
+}
+
+func (t httpFallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := t.base.RoundTrip(req)
+	if err == nil || req.URL.Scheme != "https" {
+		return response, err
+	}
+	switch errorKind(err) {
+	case "TLS", "connection refused", "connection reset":
+	default:
+		return response, err
+	}
+	if req.Header.Get("Authorization") != "" {
+		reporter.Logf("WARNING: HTTPS failed for %s, not falling back to plain HTTP as it would send the --basic-auth credentials unencrypted", req.URL)
+		return response, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.Host = ""
+	reporter.Logf("WARNING: HTTPS failed, falling back to INSECURE plain HTTP for %s: %v", req.URL, err)
+	return t.base.RoundTrip(req)
+}
+
+// errorKind classifies a network error for grouping in the summary.
+func errorKind(err error) string {
+	var statusErr *httpStatusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("HTTP %d", statusErr.StatusCode)
+	case errors.As(err, &dnsErr):
+		return "DNS"
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &certErr):
+		return "TLS"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case isConnRefused(err):
+		return "connection refused"
+	case isConnReset(err):
+		return "connection reset"
+	}
+	return "other"
+}
+
+// time every download gets with --min-speed on top of that for its size,
+// covering connecting and the server's response
+const minFileTimeout = 10 * time.Second
+
+// fileTimeout returns how long downloading size bytes may take with
+// --min-speed, or 0 for no limit. Files of unknown size are not limited.
+func fileTimeout(size int64) time.Duration {
+	if arg.MinSpeed == 0 || size <= 0 {
+		return 0
+	}
+	return minFileTimeout + time.Duration(float64(size)/float64(arg.MinSpeed)*float64(time.Second))
+}
+
+// stallTimeoutTransport fails requests that receive no data for timeout,
+// while waiting for the response or reading its body, instead of limiting
+// the duration of the whole transfer.
+type stallTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t stallTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	body := &stallReader{timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, body.stall)
+	response, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		body.timer.Stop()
+		cancel()
+		return nil, body.wrap(err)
+	}
+	body.body = response.Body
+	response.Body = body
+	return response, nil
+}
+
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (r *stallReader) stall() {
+	r.stalled.Store(true)
+	r.cancel()
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, r.wrap(err)
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
+
+// wrap turns the cancellation of a stalled request into a timeout error.
+func (r *stallReader) wrap(err error) error {
+	if err != nil && r.stalled.Load() {
+		return fmt.Errorf("no data received for %s: %w", r.timeout, os.ErrDeadlineExceeded)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+// platforms without errno values, where these errors are only grouped as
+// "other"
+
+func isConnRefused(err error) bool { return false }
+
+func isConnReset(err error) bool { return false }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorKind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + listener.Addr().String() + "/"
+	listener.Close()
+	_, refusedErr := http.Get(closedURL)
+	if refusedErr == nil {
+		t.Fatal("connecting to a closed port succeeded")
+	}
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&httpStatusError{"GET", "http://example.com/", 503, "503 Service Unavailable"}, "HTTP 503"},
+		{&url.Error{Op: "Get", URL: "http://nxdomain.invalid/", Err: &net.DNSError{Err: "no such host", Name: "nxdomain.invalid"}}, "DNS"},
+		{&url.Error{Op: "Get", URL: "https://example.com/", Err: x509.UnknownAuthorityError{}}, "TLS"},
+		{&url.Error{Op: "Get", URL: "http://example.com/", Err: context.DeadlineExceeded}, "timeout"},
+		{refusedErr, "connection refused"},
+		{errors.New("something else"), "other"},
+	}
+	for _, test := range tests {
+		if got := errorKind(test.err); got != test.want {
+			t.Errorf("errorKind(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestHTTPFallback(t *testing.T) {
+	tests := []struct {
+		extra    []string
+		fallback bool
+	}{
+		{nil, false},
+		{[]string{"--allow-http-fallback"}, true},
+		{[]string{"--allow-http-fallback", "--basic-auth", "player:hunter2"}, false},
+	}
+	for _, test := range tests {
+		srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+		// the server only speaks plain HTTP
+		srv.update(func(list *fileListYaml, files map[string][]byte) {
+			list.DownloadPrefix = strings.Replace(list.DownloadPrefix, "http://", "https://", 1)
+			files["b.txt"] = []byte("tampered")
+		})
+		rootPath := t.TempDir()
+		setupTest(t, srv.patchArgs(rootPath, append([]string{"--retries", "0"}, test.extra...)...)...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed := map[string]failureCategory{}
+		for _, f := range report.Failed {
+			failed[f.Name] = f.Category
+		}
+		if test.fallback {
+			if got := readTestFile(t, rootPath, "a.txt"); got != "a" || failed["a.txt"] != "" {
+				t.Errorf("with %q: a.txt = %q, failed as %q, want it downloaded over HTTP", test.extra, got, failed["a.txt"])
+			}
+			// still checked against the MD5
+			if failed["b.txt"] != failHashMismatch {
+				t.Errorf("with %q: b.txt failed as %q, want a hash mismatch", test.extra, failed["b.txt"])
+			}
+		} else if failed["a.txt"] != failNetwork || failed["b.txt"] != failNetwork {
+			t.Errorf("with %q: failed = %v, want network errors without falling back to HTTP", test.extra, failed)
+		}
+	}
+}
+
+func TestConnectTimeoutFailsFast(t *testing.T) {
+	setupTest(t, "--connect-timeout", "200ms")
+	started := time.Now()
+	// a reserved address that no host answers on
+	_, err := fetchUrl("http://10.255.255.1:81/filelist.yml")
+	if err == nil {
+		t.Fatal("fetching from an unroutable host succeeded")
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("failed after %s with --connect-timeout 200ms", took)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			if r.URL.Path == "/stalled" && i == 2 {
+				<-r.Context().Done()
+				return
+			}
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	setupTest(t, "--read-timeout", "150ms")
+
+	// slower in total than the read timeout, but steady
+	if data, err := fetchUrl(srv.URL + "/steady"); err != nil || string(data) != "xxxxx" {
+		t.Errorf("steady download = %q, %v", data, err)
+	}
+	started := time.Now()
+	if _, err := fetchUrl(srv.URL + "/stalled"); err == nil {
+		t.Error("stalled download succeeded")
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("stalled download failed after %s with --read-timeout 150ms", took)
+	}
+}
+
+func TestFileTimeoutIsProportionalToSize(t *testing.T) {
+	tests := []struct {
+		args []string
+		size int64
+		want time.Duration
+	}{
+		{[]string{"--min-speed", "50K"}, 2 << 10, minFileTimeout + 40*time.Millisecond},
+		{[]string{"--min-speed", "50K"}, 50 << 10, minFileTimeout + time.Second},
+		{[]string{"--min-speed", "50K"}, 2 << 30, minFileTimeout + 41943040*time.Millisecond},
+		{[]string{"--min-speed", "1M"}, 2 << 30, minFileTimeout + 2048*time.Second},
+		{[]string{"--min-speed", "50K"}, 0, 0},
+		{nil, 2 << 30, 0},
+	}
+	for _, test := range tests {
+		setupTest(t, test.args...)
+		if got := fileTimeout(test.size); got != test.want {
+			t.Errorf("fileTimeout(%d) with %q = %s, want %s", test.size, test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// printURLs prints the filelist URL of rootPath and the first count
+// download URLs of its cached filelist, without any network access.
+func printURLs(rootPath string, count int) error {
+	cachePath, expansion, client, err := manifestCachePath(rootPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, manifestURL(client, expansion))
+
+	if !fileOrDirExists(cachePath) {
+		fmt.Fprintln(stdout, "# no cached filelist, run once without --print-url-only to list download URLs")
+		return nil
+	}
+	list, err := readFileList(cachePath)
+	if err != nil {
+		return err
+	}
+	for i, dl := range list.Downloads {
+		if i >= count {
+			break
+		}
+		fmt.Fprintln(stdout, list.downloadURL(dl))
+	}
+	return nil
+}
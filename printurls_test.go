@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPrintURLs(t *testing.T) {
+	rootPath := t.TempDir()
+	out := setupTest(t, "patch", rootPath, "--client", "rof", "--expansion", "original", "--print-url-only")
+	if err := printURLs(rootPath, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := "https://original.fvproject.com/rof/filelist_rof.yml\n# no cached filelist, run once without --print-url-only to list download URLs\n"
+	if out.String() != want {
+		t.Errorf("without a cached filelist printed:\n%s\nwant:\n%s", out, want)
+	}
+
+	list := fileListYaml{Version: "1", DownloadPrefix: "https://cdn.example.com/rof/", Downloads: []fileEntry{
+		{Name: "a.txt"},
+		{Name: "maps/b.eqg", URL: "https://other.example.com/b.eqg"},
+		{Name: "c.txt", Compression: compressionZstd},
+		{Name: "d.txt"},
+	}}
+	data, err := yaml.Marshal(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath, _, _, err := manifestCachePath(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, filepath.Dir(cachePath), map[string]string{filepath.Base(cachePath): string(data)})
+	printed := len(out.String())
+	if err := printURLs(rootPath, 3); err != nil {
+		t.Fatal(err)
+	}
+	want = strings.Join([]string{
+		"https://original.fvproject.com/rof/filelist_rof.yml",
+		"https://cdn.example.com/rof/a.txt",
+		"https://other.example.com/b.eqg",
+		"https://cdn.example.com/rof/c.txt.zst",
+	}, "\n") + "\n"
+	if got := out.String()[printed:]; got != want {
+		t.Errorf("printed:\n%s\nwant:\n%s", got, want)
+	}
+}
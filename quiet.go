@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// quietBuffer holds the output of a --quiet run until it is known whether
+// anything happened that is worth printing.
+type quietBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *quietBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// flush writes the held output to w if print is set, and discards it either
+// way.
+func (b *quietBuffer) flush(w io.Writer, print bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !print {
+		b.buf.Reset()
+		return nil
+	}
+	_, err := b.buf.WriteTo(w)
+	return err
+}
+
+// hasChanges reports whether r recorded any changes or failures.
+func (r *runReport) hasChanges() bool {
+	return len(r.Deleted) > 0 || len(r.Downloaded) > 0 || len(r.Failed) > 0 || r.Aborted != ""
+}
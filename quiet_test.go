@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietPrintsOnlyChanges(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "a"})
+
+	// quietRun patches rootPath like main does with --quiet, returning what
+	// is printed
+	quietRun := func() string {
+		setupTest(t, srv.patchArgs(rootPath, "--quiet")...)
+		held := &quietBuffer{}
+		stdout = held
+		_, failed, changed := patchRoots([]string{rootPath}, time.Time{})
+		var out bytes.Buffer
+		if err := held.flush(&out, changed || failed); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	if out := quietRun(); out != "" {
+		t.Errorf("printed %q for a current install, want nothing", out)
+	}
+
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		list.Version = "2"
+		files["a.txt"] = []byte("new a")
+		list.Downloads[0].MD5 = md5Hex("new a")
+		list.Downloads[0].Size = 5
+	})
+	if out := quietRun(); !strings.Contains(out, "a.txt") {
+		t.Errorf("printed %q after downloading a.txt", out)
+	}
+	if got := readTestFile(t, rootPath, "a.txt"); got != "new a" {
+		t.Errorf("a.txt = %q, want it updated", got)
+	}
+}
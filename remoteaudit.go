@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// number of bytes from the start of each file compared by --compare-with-remote
+const remoteCompareBytes = 4096
+
+// compareWithRemote compares the size and first bytes of the local files of
+// rootPath with the server's copies, without downloading them in full. It
+// returns the number of files that look diverged.
+func compareWithRemote(rootPath string) (int, error) {
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		return 0, err
+	}
+	results := make([]string, len(list.Downloads))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < arg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer writeCrashDiagnostics()
+			for i := range queue {
+				results[i] = list.compareFile(rootPath, list.Downloads[i])
+			}
+		}()
+	}
+	for i := range list.Downloads {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	diverged := 0
+	for i, result := range results {
+		if result != "" {
+			fmt.Fprintln(stdout, "DIVERGED", list.Downloads[i].Name+":", result)
+			diverged++
+		}
+	}
+	fmt.Fprintf(stdout, "%d of %d files look diverged from the server\n", diverged, len(list.Downloads))
+	return diverged, nil
+}
+
+// compareFile returns why the local copy of dl differs from the server's, or
+// "" if it looks the same or is missing. Compressed files can't be compared
+// this way and are skipped.
+func (list *fileListYaml) compareFile(rootPath string, dl fileEntry) string {
+	if dl.Compression != "" {
+		return ""
+	}
+	fullPath := filepath.Join(rootPath, dl.Name)
+	info, err := storage.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		return err.Error()
+	}
+	f, err := storage.Open(fullPath)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	local := make([]byte, remoteCompareBytes)
+	n, err := io.ReadFull(f, local)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err.Error()
+	}
+	local = local[:n]
+
+	var remote []byte
+	var remoteSize int64
+	url := list.downloadURL(dl)
+	err = withRetry(url, func() (err error) {
+		remote, remoteSize, err = fetchHead(url, remoteCompareBytes)
+		return err
+	})
+	if err != nil {
+		return "could not check: " + err.Error()
+	}
+	if remoteSize >= 0 && remoteSize != info.Size() {
+		return fmt.Sprintf("size is %d bytes, the server has %d", info.Size(), remoteSize)
+	}
+	if !bytes.Equal(local, remote) {
+		return fmt.Sprintf("the first %d bytes differ from the server", len(local))
+	}
+	return ""
+}
+
+// fetchHead returns up to n bytes from the start of url and its total size,
+// or -1 if the server doesn't tell.
+func fetchHead(url string, n int) ([]byte, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	response, err := newHTTPClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	size := int64(-1)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-4095/12345
+		if _, total, ok := strings.Cut(response.Header.Get("Content-Range"), "/"); ok {
+			if v, err := strconv.ParseInt(total, 10, 64); err == nil {
+				size = v
+			}
+		}
+	case http.StatusOK:
+		size = response.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is empty
+		return []byte{}, 0, nil
+	default:
+		return nil, 0, &httpStatusError{"GET", url, response.StatusCode, response.Status}
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, int64(n)))
+	return data, size, err
+}
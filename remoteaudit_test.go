@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompareWithRemoteFlagsDivergedFiles(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	srv := newTestServer(t, map[string]string{"same.bin": content, "changed.bin": content, "truncated.bin": content, "missing.bin": content})
+	var mu sync.Mutex
+	fullRequests := []string{}
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/files/") && r.Header.Get("Range") == "" {
+			mu.Lock()
+			fullRequests = append(fullRequests, r.URL.Path)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{
+		"same.bin":      content,
+		"changed.bin":   "X" + content[1:],
+		"truncated.bin": content[:50000],
+	})
+	out := setupTest(t, srv.patchArgs(rootPath, "--compare-with-remote")...)
+
+	diverged, err := compareWithRemote(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diverged != 2 {
+		t.Errorf("%d files diverged, want 2:\n%s", diverged, out)
+	}
+	for _, line := range []string{
+		"DIVERGED changed.bin: the first 4096 bytes differ from the server",
+		"DIVERGED truncated.bin: size is 50000 bytes, the server has 100000",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output is missing %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out.String(), "same.bin") || strings.Contains(out.String(), "missing.bin") {
+		t.Errorf("an unchanged or missing file was flagged:\n%s", out)
+	}
+	if len(fullRequests) != 0 {
+		t.Errorf("requested whole files: %q", fullRequests)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+type failureCategory string
+
+const (
+	failNetwork      failureCategory = "network"
+	failHashMismatch failureCategory = "hash-mismatch"
+	failFilesystem   failureCategory = "filesystem"
+	failServerDrift  failureCategory = "server-mismatch"
+)
+
+var failureCategories = []failureCategory{failNetwork, failHashMismatch, failFilesystem, failServerDrift}
+
+var failureHints = map[failureCategory]string{
+	failNetwork:      "check your internet connection or try again later",
+	failHashMismatch: "the server sent unexpected data, please report this",
+	failFilesystem:   "check disk space and permissions of the install folder",
+	failServerDrift:  "the server does not serve what the manifest describes, please report this",
+}
+
+// number of example failures listed per kind of network error
+const failureExamples = 3
+
+type fileFailure struct {
+	Name     string          `json:"name"`
+	Category failureCategory `json:"category"`
+	Kind     string          `json:"kind,omitempty"`
+	Error    string          `json:"error"`
+}
+
+type runReport struct {
+	Root       string        `json:"root"`
+	Version    string        `json:"version"`
+	Deleted    []string      `json:"deleted"`
+	Downloaded []string      `json:"downloaded"`
+	Unchanged  []string      `json:"unchanged,omitempty"`
+	Deferred   []string      `json:"deferred,omitempty"`
+	Failed     []fileFailure `json:"failed"`
+	Aborted    string        `json:"aborted,omitempty"`
+
+	// set if the root could not be patched at all
+	Error string `json:"error,omitempty"`
+
+	// set if the run was interrupted, with the downloads that were cut off
+	// and those not started yet
+	Cancelled bool     `json:"cancelled,omitempty"`
+	InFlight  []string `json:"in_flight,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+
+	mu sync.Mutex
+}
+
+func newRunReport(rootPath, version string) *runReport {
+	return &runReport{
+		Root:       rootPath,
+		Version:    version,
+		Deleted:    []string{},
+		Downloaded: []string{},
+		Failed:     []fileFailure{},
+	}
+}
+
+func (r *runReport) addFailure(name string, category failureCategory, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := fileFailure{Name: name, Category: category, Error: err.Error()}
+	if category == failNetwork {
+		f.Kind = errorKind(err)
+	}
+	r.Failed = append(r.Failed, f)
+}
+
+func (r *runReport) addDeferred(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Deferred = append(r.Deferred, name)
+}
+
+func (r *runReport) addInFlight(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.InFlight = append(r.InFlight, name)
+}
+
+func (r *runReport) addPending(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Pending = append(r.Pending, name)
+}
+
+func (r *runReport) addDownloaded(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Downloaded = append(r.Downloaded, name)
+}
+
+func (r *runReport) PrintSummary() {
+	if arg.ReportUnchanged {
+		fmt.Fprintf(stdout, "%d files were already up to date\n", len(r.Unchanged))
+	}
+	if len(r.Deferred) > 0 {
+		fmt.Fprintf(stdout, "%d files were deferred to a later run\n", len(r.Deferred))
+	}
+	if r.Cancelled {
+		fmt.Fprintf(stdout, "Cancelled with %d files downloaded, %d cut off and %d not started. Run with --retry-failed to resume\n",
+			len(r.Downloaded), len(r.InFlight), len(r.Pending))
+	} else if len(r.Pending) > 0 {
+		fmt.Fprintf(stdout, "%d files were not started. Run with --retry-failed to resume\n", len(r.Pending))
+	}
+	if len(r.Failed) == 0 {
+		return
+	}
+	fmt.Fprintf(stdout, "%d files failed:\n", len(r.Failed))
+	for _, category := range failureCategories {
+		count := 0
+		for _, f := range r.Failed {
+			if f.Category == category {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		fmt.Fprintf(stdout, "- %d %s errors, %s\n", count, category, failureHints[category])
+		if category == failNetwork {
+			r.printNetworkFailures()
+			continue
+		}
+		for _, f := range r.Failed {
+			if f.Category == category {
+				fmt.Fprintln(stdout, "  ", f.Name+":", f.Error)
+			}
+		}
+	}
+}
+
+// printNetworkFailures prints the network failures grouped by kind, most
+// common first, with a few examples of each.
+func (r *runReport) printNetworkFailures() {
+	byKind := map[string][]fileFailure{}
+	kinds := []string{}
+	for _, f := range r.Failed {
+		if f.Category != failNetwork {
+			continue
+		}
+		if _, ok := byKind[f.Kind]; !ok {
+			kinds = append(kinds, f.Kind)
+		}
+		byKind[f.Kind] = append(byKind[f.Kind], f)
+	}
+	sort.SliceStable(kinds, func(i, j int) bool { return len(byKind[kinds[i]]) > len(byKind[kinds[j]]) })
+	for _, kind := range kinds {
+		failures := byKind[kind]
+		fmt.Fprintf(stdout, "   %d %s:\n", len(failures), kind)
+		for i, f := range failures {
+			if i == failureExamples {
+				fmt.Fprintf(stdout, "     ... and %d more\n", len(failures)-failureExamples)
+				break
+			}
+			fmt.Fprintln(stdout, "    ", f.Name+":", f.Error)
+		}
+	}
+}
+
+// writeJSONReports writes the report of a single root as a JSON object, or
+// of multiple roots as an array. Roots that failed to patch are reported with
+// their error from errs, so a report of an earlier run is always replaced.
+func writeJSONReports(fileName string, roots []string, reports []*runReport, errs []error) error {
+	all := make([]*runReport, len(reports))
+	for i, r := range reports {
+		if r == nil {
+			r = newRunReport(roots[i], "")
+			r.Error = errs[i].Error()
+		}
+		all[i] = r
+	}
+	var v interface{} = all
+	if len(all) == 1 {
+		v = all[0]
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0666)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailuresAreCategorized(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"good.txt": "good", "bad.txt": "bad", "blocked/file.txt": "blocked"})
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		files["bad.txt"] = []byte("an error page")
+		list.Downloads = append(list.Downloads, fileEntry{Name: "missing.txt", MD5: md5Hex("missing"), Size: 7})
+	})
+	rootPath := t.TempDir()
+	// a file where the folder of blocked/file.txt should be
+	writeTestFiles(t, rootPath, map[string]string{"blocked": "not a folder"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]failureCategory{
+		"bad.txt":          failHashMismatch,
+		"missing.txt":      failNetwork,
+		"blocked/file.txt": failFilesystem,
+	}
+	got := map[string]failureCategory{}
+	for _, f := range report.Failed {
+		got[filepath.ToSlash(f.Name)] = f.Category
+	}
+	for name, category := range want {
+		if got[name] != category {
+			t.Errorf("%s failed as %q, want %q", name, got[name], category)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("failed = %v, want %v", got, want)
+	}
+
+	report.PrintSummary()
+	for _, line := range []string{"1 network errors", "1 hash-mismatch errors", "1 filesystem errors"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("summary is missing %q:\n%s", line, out)
+		}
+	}
+
+	fileName := filepath.Join(t.TempDir(), "report.json")
+	if err := writeJSONReports(fileName, []string{report.Root}, []*runReport{report}, []error{nil}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded runReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range decoded.Failed {
+		if f.Category != want[filepath.ToSlash(f.Name)] {
+			t.Errorf("JSON report has %s as %q, want %q", f.Name, f.Category, want[f.Name])
+		}
+	}
+}
+
+func TestReportUnchanged(t *testing.T) {
+	for _, flag := range []bool{false, true} {
+		srv := newTestServer(t, map[string]string{"current.txt": "current", "new.txt": "new"})
+		rootPath := t.TempDir()
+		writeTestFiles(t, rootPath, map[string]string{"current.txt": "current"})
+		args := srv.patchArgs(rootPath)
+		if flag {
+			args = append(args, "--report-unchanged")
+		}
+		out := setupTest(t, args...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		report.PrintSummary()
+		data, err := json.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := len(report.Unchanged) == 1 && report.Unchanged[0] == "current.txt"
+		inSummary := strings.Contains(out.String(), "1 files were already up to date")
+		inJSON := strings.Contains(string(data), `"unchanged":["current.txt"]`)
+		if listed != flag || inSummary != flag || inJSON != flag {
+			t.Errorf("with --report-unchanged %v: unchanged = %q, in summary %v, in JSON %v",
+				flag, report.Unchanged, inSummary, inJSON)
+		}
+	}
+}
+
+func TestNetworkFailuresGroupedByKind(t *testing.T) {
+	out := setupTest(t, "patch", t.TempDir())
+	report := newRunReport("root", "1")
+	for i := 0; i < 5; i++ {
+		report.addFailure(fmt.Sprintf("missing%d.txt", i), failNetwork, &httpStatusError{"GET", "http://example.com/", 404, "404 Not Found"})
+	}
+	for i := 0; i < 2; i++ {
+		report.addFailure(fmt.Sprintf("dns%d.txt", i), failNetwork, &url.Error{Op: "Get", URL: "http://nxdomain.invalid/", Err: &net.DNSError{Err: "no such host", Name: "nxdomain.invalid"}})
+	}
+	report.addFailure("slow.txt", failNetwork, &url.Error{Op: "Get", URL: "http://example.com/", Err: context.DeadlineExceeded})
+	report.addFailure("bad.txt", failHashMismatch, &hashMismatchError{Expected: md5Hex("a"), Actual: md5Hex("b")})
+
+	report.PrintSummary()
+	summary := out.String()
+	lines := []string{
+		"9 files failed:",
+		"- 8 network errors",
+		"   5 HTTP 404:",
+		"     ... and 2 more",
+		"   2 DNS:",
+		"   1 timeout:",
+		"- 1 hash-mismatch errors",
+	}
+	last := -1
+	for _, line := range lines {
+		i := strings.Index(summary, line)
+		if i < 0 {
+			t.Errorf("summary is missing %q:\n%s", line, summary)
+			continue
+		}
+		if i < last {
+			t.Errorf("%q is out of order in summary:\n%s", line, summary)
+		}
+		last = i
+	}
+	if n := strings.Count(summary, "missing"); n != failureExamples {
+		t.Errorf("%d examples of HTTP 404 listed, want %d:\n%s", n, failureExamples, summary)
+	}
+}
+
+func TestJSONReportOfFailedRootReplacesEarlier(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "report.json")
+	earlier := newRunReport("/games/eq", "1")
+	earlier.Downloaded = []string{"a.txt"}
+	if err := writeJSONReports(fileName, []string{"/games/eq"}, []*runReport{earlier}, []error{nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := []error{fmt.Errorf("filelist not found")}
+	if err := writeJSONReports(fileName, []string{"/games/eq"}, []*runReport{nil}, errs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded runReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Root != "/games/eq" || decoded.Error != "filelist not found" || len(decoded.Downloaded) != 0 {
+		t.Errorf("report = %s, want the failure of this run", data)
+	}
+
+	// with multiple roots, the failed ones are listed with their error
+	errs = []error{nil, fmt.Errorf("filelist not found")}
+	if err := writeJSONReports(fileName, []string{"/games/eq", "/games/eq2"}, []*runReport{earlier, nil}, errs); err != nil {
+		t.Fatal(err)
+	}
+	var multi []runReport
+	if data, err = os.ReadFile(fileName); err == nil {
+		err = json.Unmarshal(data, &multi)
+	}
+	if err != nil || len(multi) != 2 || multi[0].Error != "" || multi[1].Root != "/games/eq2" || multi[1].Error == "" {
+		t.Errorf("report = %s, %v", data, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reporter receives the events of the hashing and download phases.
+type Reporter interface {
+	Logf(format string, a ...interface{})
+	HashProgress(done, total int, bytes int64)
+	DownloadsQueued(count int)
+	FetchStarted(url string)
+	FetchProgress(url string, n int)
+	FetchDone(url string)
+	FileDone(name string, err error)
+	Close()
+}
+
+var reporter Reporter = plainReporter{}
+
+func newReporter(tui bool) Reporter {
+	if tui {
+		if isTerminal(os.Stdout) {
+			return newTUIReporter()
+		}
+		fmt.Fprintln(stdout, "stdout is not a terminal, ignoring --tui")
+	}
+	return plainReporter{}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// plainReporter prints log lines and the hashing progress, ignoring download
+// progress events.
+type plainReporter struct{}
+
+func (plainReporter) Logf(format string, a ...interface{}) { fmt.Fprintf(stdout, format+"\n", a...) }
+func (plainReporter) DownloadsQueued(count int)            {}
+func (plainReporter) FetchStarted(url string)              {}
+func (plainReporter) FetchProgress(url string, n int)      {}
+func (plainReporter) FetchDone(url string)                 {}
+func (plainReporter) FileDone(name string, err error)      {}
+func (plainReporter) Close()                               {}
+
+func (plainReporter) HashProgress(done, total int, bytes int64) {
+	fmt.Fprintf(stdout, "Checked %d/%d local files, %s\n", done, total, formatBytes(bytes))
+}
+
+// tuiReporter keeps a status block with overall progress and the active
+// fetches at the bottom of the terminal, scrolling log lines above it.
+type tuiReporter struct {
+	mu         sync.Mutex
+	started    time.Time
+	total      int
+	done       int
+	failed     int
+	bytes      int64
+	active     map[string]int64
+	hashDone   int
+	hashTotal  int
+	hashBytes  int64
+	drawnLines int
+	lastDraw   time.Time
+}
+
+func newTUIReporter() *tuiReporter {
+	return &tuiReporter{started: time.Now(), active: map[string]int64{}}
+}
+
+func (r *tuiReporter) Logf(format string, a ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clear()
+	fmt.Fprintf(stdout, format+"\n", a...)
+	r.draw()
+}
+
+func (r *tuiReporter) HashProgress(done, total int, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashDone, r.hashTotal, r.hashBytes = done, total, bytes
+	r.redraw()
+}
+
+// DownloadsQueued starts the progress of a new download phase, which happens
+// once per root and --refresh-interval cycle.
+func (r *tuiReporter) DownloadsQueued(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total, r.done, r.failed = count, 0, 0
+	r.bytes, r.started = 0, time.Now()
+	r.redraw()
+}
+
+func (r *tuiReporter) FetchStarted(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[url] = 0
+	r.redraw()
+}
+
+func (r *tuiReporter) FetchProgress(url string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[url] += int64(n)
+	r.bytes += int64(n)
+	if time.Since(r.lastDraw) > 100*time.Millisecond {
+		r.redraw()
+	}
+}
+
+func (r *tuiReporter) FetchDone(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, url)
+	r.redraw()
+}
+
+func (r *tuiReporter) FileDone(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done++
+	if err != nil {
+		r.failed++
+	}
+	r.redraw()
+}
+
+func (r *tuiReporter) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clear()
+}
+
+func (r *tuiReporter) redraw() {
+	r.clear()
+	r.draw()
+}
+
+// clear erases the previously drawn status block.
+func (r *tuiReporter) clear() {
+	for ; r.drawnLines > 0; r.drawnLines-- {
+		fmt.Fprint(stdout, "\x1b[1A\x1b[2K")
+	}
+}
+
+func (r *tuiReporter) draw() {
+	if r.total == 0 {
+		if r.hashTotal > 0 && r.hashDone < r.hashTotal {
+			fmt.Fprintf(stdout, "[%s] checked %d/%d local files, %s\n",
+				progressBar(r.hashDone, r.hashTotal, 30), r.hashDone, r.hashTotal, formatBytes(r.hashBytes))
+			r.drawnLines = 1
+		}
+		return
+	}
+	speed := float64(r.bytes) / time.Since(r.started).Seconds()
+	lines := []string{fmt.Sprintf("[%s] %d/%d files, %d failed, %s/s",
+		progressBar(r.done, r.total, 30), r.done, r.total, r.failed, formatBytes(int64(speed)))}
+
+	urls := make([]string, 0, len(r.active))
+	for url := range r.active {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		lines = append(lines, fmt.Sprintf("  %s %s", path.Base(url), formatBytes(r.active[url])))
+	}
+	for _, line := range lines {
+		fmt.Fprintln(stdout, line)
+	}
+	r.drawnLines = len(lines)
+	r.lastDraw = time.Now()
+}
+
+func progressBar(done, total, width int) string {
+	filled := width * done / total
+	if filled > width {
+		filled = width
+	}
+	return strings.Repeat("#", filled) + strings.Repeat(".", width-filled)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTUIReporterRecordsEvents(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "aaaa", "b.txt": "bbbb", "c.txt": "cccc"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "c.txt") })
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	r := newTUIReporter()
+	reporter = r
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if r.total != 3 || r.done != 3 || r.failed != 1 {
+		t.Errorf("%d/%d files done, %d failed, want 3/3 and 1", r.done, r.total, r.failed)
+	}
+	if len(r.active) != 0 {
+		t.Errorf("fetches still active: %v", r.active)
+	}
+	if r.bytes != 8 {
+		t.Errorf("received %d bytes, want 8", r.bytes)
+	}
+	if !strings.Contains(out.String(), "3/3 files, 1 failed") {
+		t.Errorf("progress not drawn:\n%s", out)
+	}
+
+	// the next root or refresh cycle starts from zero
+	r.DownloadsQueued(2)
+	if r.total != 2 || r.done != 0 || r.failed != 0 || r.bytes != 0 {
+		t.Errorf("after DownloadsQueued(2): %d/%d files, %d failed, %d bytes", r.done, r.total, r.failed, r.bytes)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	tests := []struct {
+		done, total int
+		want        string
+	}{
+		{0, 4, "...."},
+		{2, 4, "##.."},
+		{4, 4, "####"},
+		{6, 4, "####"},
+	}
+	for _, tt := range tests {
+		if got := progressBar(tt.done, tt.total, 4); got != tt.want {
+			t.Errorf("progressBar(%d, %d, 4) = %q, want %q", tt.done, tt.total, got, tt.want)
+		}
+	}
+}
+
+// eventRecorder records the download events a Reporter receives.
+type eventRecorder struct {
+	plainReporter
+	mu      sync.Mutex
+	queued  int
+	started map[string]int
+	bytes   map[string]int
+	done    map[string]int
+	files   map[string]error
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{started: map[string]int{}, bytes: map[string]int{}, done: map[string]int{}, files: map[string]error{}}
+}
+
+func (r *eventRecorder) DownloadsQueued(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queued = count
+}
+
+func (r *eventRecorder) FetchStarted(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started[path.Base(url)]++
+}
+
+func (r *eventRecorder) FetchProgress(url string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes[path.Base(url)] += n
+}
+
+func (r *eventRecorder) FetchDone(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done[path.Base(url)]++
+}
+
+func (r *eventRecorder) FileDone(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[name] = err
+}
+
+func TestReporterReceivesFileEvents(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "aaaa", "b.txt": "bb", "gone.txt": "gone"})
+	srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "gone.txt") })
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	r := newEventRecorder()
+	reporter = r
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if r.queued != 3 {
+		t.Errorf("%d downloads queued, want 3", r.queued)
+	}
+	// failed requests without a body to receive have no fetch
+	for name, size := range map[string]int{"a.txt": 4, "b.txt": 2, "gone.txt": 0} {
+		fetches := 1
+		if size == 0 {
+			fetches = 0
+		}
+		if r.started[name] != fetches || r.done[name] != fetches || r.bytes[name] != size {
+			t.Errorf("%s: started %d, done %d, %d bytes, want %d fetches of %d bytes", name, r.started[name], r.done[name], r.bytes[name], fetches, size)
+		}
+		err, ok := r.files[name]
+		if !ok || (err != nil) != (name == "gone.txt") {
+			t.Errorf("%s: done %v with error %v", name, ok, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func validateRetryArgs() error {
+	if arg.Retries < 0 {
+		return fmt.Errorf("--retries must be 0 or more, got %d", arg.Retries)
+	}
+	if arg.RetryBaseDelay <= 0 {
+		return fmt.Errorf("--retry-base-delay must be positive, got %s", arg.RetryBaseDelay)
+	}
+	if arg.RetryMaxDelay < arg.RetryBaseDelay {
+		return fmt.Errorf("--retry-max-delay (%s) must not be less than --retry-base-delay (%s)", arg.RetryMaxDelay, arg.RetryBaseDelay)
+	}
+	if arg.MaxTotalRetries < 0 {
+		return fmt.Errorf("--max-total-retries must be 0 or more, got %d", arg.MaxTotalRetries)
+	}
+	if arg.RetryJitter < 0 || arg.RetryJitter > 1 {
+		return fmt.Errorf("--retry-jitter must be between 0 and 1, got %v", arg.RetryJitter)
+	}
+	return nil
+}
+
+// backoffDelay returns the delay before retry number attempt (starting at 1).
+// The delay doubles per attempt from base, is capped at max, and is then
+// reduced by a random amount of up to jitter (a fraction of the delay).
+func backoffDelay(attempt int, base, max time.Duration, jitter float64) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if jitter > 0 {
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
+
+var (
+	// number of retries made in this run, limited by --max-total-retries
+	totalRetries         atomic.Int64
+	retryBudgetExhausted sync.Once
+)
+
+// takeRetry reports whether the run's retry budget allows another retry.
+func takeRetry() bool {
+	if arg.MaxTotalRetries == 0 || totalRetries.Add(1) <= int64(arg.MaxTotalRetries) {
+		return true
+	}
+	retryBudgetExhausted.Do(func() {
+		reporter.Logf("- All %d retries of this run are used up, not retrying any more", arg.MaxTotalRetries)
+	})
+	return false
+}
+
+func fetchUrlWithRetry(url string) ([]byte, error) {
+	var data []byte
+	err := withRetry(url, func() (err error) {
+		data, err = fetchUrl(url)
+		return err
+	})
+	return data, err
+}
+
+// withRetry calls fn, which requests url, until it succeeds or --retries or
+// --max-total-retries is exhausted, waiting with backoff between attempts.
+func withRetry(url string, fn func() error) error {
+	var lastErr error
+	for attempt := 0; attempt <= arg.Retries; attempt++ {
+		if attempt > 0 {
+			if cancelled() || !takeRetry() {
+				break
+			}
+			delay := backoffDelay(attempt, arg.RetryBaseDelay, arg.RetryMaxDelay, arg.RetryJitter)
+			reporter.Logf("- Retry %d/%d in %s: %v", attempt, arg.Retries, delay.Round(time.Millisecond), lastErr)
+			sleepUnlessCancelled(delay)
+		}
+		release := hostLimits.acquire(url)
+		err := fn()
+		release()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// isRetryable reports whether a request failing with err may succeed when
+// retried: on network errors and HTTP 408, 429 and 5xx, but not on other
+// client errors such as 403 or 404, nor on unknown host names unless
+// --retry-dns-not-found is set.
+func isRetryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound || arg.RetryDNSNotFound
+	}
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code >= 400 && code < 500:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelayStaysWithinBounds(t *testing.T) {
+	tests := []struct {
+		attempt   int
+		base, max time.Duration
+		jitter    float64
+		want      time.Duration
+	}{
+		{1, time.Second, 30 * time.Second, 0, time.Second},
+		{2, time.Second, 30 * time.Second, 0, 2 * time.Second},
+		{4, time.Second, 30 * time.Second, 0, 8 * time.Second},
+		{10, time.Second, 30 * time.Second, 0, 30 * time.Second},
+		{3, 500 * time.Millisecond, 10 * time.Second, 0.2, 2 * time.Second},
+		{20, time.Second, 5 * time.Second, 0.5, 5 * time.Second},
+		{1, time.Second, time.Second, 1, time.Second},
+	}
+	for _, tt := range tests {
+		min := tt.want - time.Duration(tt.jitter*float64(tt.want))
+		for i := 0; i < 1000; i++ {
+			got := backoffDelay(tt.attempt, tt.base, tt.max, tt.jitter)
+			if got < min || got > tt.want {
+				t.Fatalf("backoffDelay(%d, %s, %s, %v) = %s, want between %s and %s",
+					tt.attempt, tt.base, tt.max, tt.jitter, got, min, tt.want)
+			}
+		}
+	}
+}
+
+func TestValidateRetryArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"--retry-jitter", "1"}, true},
+		{[]string{"--retry-jitter", "1.5"}, false},
+		{[]string{"--retry-jitter=-0.1"}, false},
+		{[]string{"--retry-base-delay", "5s", "--retry-max-delay", "1s"}, false},
+		{[]string{"--retry-base-delay", "0s"}, false},
+		{[]string{"--retries=-1"}, false},
+	}
+	for _, tt := range tests {
+		setupTest(t, tt.args...)
+		if err := validateRetryArgs(); (err == nil) != tt.ok {
+			t.Errorf("validateRetryArgs() with %q = %v, want ok %v", tt.args, err, tt.ok)
+		}
+	}
+}
+
+func TestWithRetryGivesUpAfterRetries(t *testing.T) {
+	setupTest(t, "--retries", "2", "--retry-base-delay", "1ms", "--retry-max-delay", "2ms")
+	calls := 0
+	err := withRetry("http://example.invalid/file", func() error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("withRetry() = %v after %d calls, want an error after 3", err, calls)
+	}
+
+	calls = 0
+	err = withRetry("http://example.invalid/file", func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("withRetry() = %v after %d calls, want success after 2", err, calls)
+	}
+}
+
+func TestMaxTotalRetriesCapsRetriesAcrossFiles(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c", "d.txt": "d"})
+	var fileRequests atomic.Int64
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/files/") {
+			fileRequests.Add(1)
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--retries", "5", "--max-total-retries", "3")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 4 {
+		t.Errorf("%d files failed, want 4", len(report.Failed))
+	}
+	// one attempt per file, and 3 retries shared between them
+	if n := fileRequests.Load(); n != 4+3 {
+		t.Errorf("%d file requests, want %d", n, 4+3)
+	}
+	if n := strings.Count(out.String(), "retries of this run are used up"); n != 1 {
+		t.Errorf("budget exhaustion reported %d times, want once:\n%s", n, out)
+	}
+}
+
+func TestStatusCodesRetried(t *testing.T) {
+	tests := []struct {
+		code  int
+		retry bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusGone, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+	}
+	for _, tt := range tests {
+		var requests atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(tt.code)
+		}))
+		setupTest(t, "--retries", "2", "--retry-base-delay", "1ms", "--retry-max-delay", "1ms")
+
+		_, err := fetchUrlWithRetry(srv.URL + "/a.txt")
+		srv.Close()
+		if got := isRetryable(err); got != tt.retry {
+			t.Errorf("isRetryable() of HTTP %d = %v, want %v", tt.code, got, tt.retry)
+		}
+		want := int64(1)
+		if tt.retry {
+			want = 3
+		}
+		if n := requests.Load(); n != want {
+			t.Errorf("HTTP %d was requested %d times, want %d", tt.code, n, want)
+		}
+	}
+
+	// wrapped status errors and other failures
+	notFound := &httpStatusError{"GET", "http://example.com/a.txt", 404, "404 Not Found"}
+	if isRetryable(fmt.Errorf("downloading a.txt: %w", notFound)) {
+		t.Error("a wrapped 404 is retried")
+	}
+	if !isRetryable(errors.New("connection reset")) {
+		t.Error("a network error is not retried")
+	}
+}
+
+func TestDNSFailuresRetried(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) }))
+	defer srv.Close()
+	tests := []struct {
+		dnsErr *net.DNSError
+		extra  []string
+		ok     bool
+	}{
+		{&net.DNSError{Err: "server misbehaving", Name: "files.example.com", IsTemporary: true}, nil, true},
+		{&net.DNSError{Err: "i/o timeout", Name: "files.example.com", IsTimeout: true}, nil, true},
+		{&net.DNSError{Err: "no such host", Name: "files.example.com", IsNotFound: true}, nil, false},
+		{&net.DNSError{Err: "no such host", Name: "files.example.com", IsNotFound: true}, []string{"--retry-dns-not-found"}, true},
+	}
+	for _, tt := range tests {
+		setupTest(t, append([]string{"--retries", "2", "--retry-base-delay", "1ms", "--retry-max-delay", "1ms"}, tt.extra...)...)
+		// the first lookup fails
+		tr := sharedTransport()
+		dial := tr.DialContext
+		dials := 0
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			if dials == 1 {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: tt.dnsErr}
+			}
+			return dial(ctx, network, addr)
+		}
+
+		data, err := fetchUrlWithRetry(srv.URL + "/a.txt")
+		if tt.ok && (err != nil || string(data) != "a" || dials != 2) {
+			t.Errorf("%v with %q: got %q, %v after %d dials, want success on the retry", tt.dnsErr, tt.extra, data, err, dials)
+		}
+		if !tt.ok && (err == nil || dials != 1) {
+			t.Errorf("%v with %q: got %v after %d dials, want a failure without retrying", tt.dnsErr, tt.extra, err, dials)
+		}
+	}
+}
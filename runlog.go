@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	runLogName     = "runs.log"
+	runLogMaxSize  = 1 << 20
+	runLogMaxFiles = 3
+)
+
+var runLogMu sync.Mutex
+
+type runLogEntry struct {
+	Time       time.Time     `json:"time"`
+	Root       string        `json:"root"`
+	Version    string        `json:"version"`
+	DryRun     bool          `json:"dry_run,omitempty"`
+	Deleted    int           `json:"deleted"`
+	Downloaded int           `json:"downloaded"`
+	Failed     []fileFailure `json:"failed,omitempty"`
+	Aborted    string        `json:"aborted,omitempty"`
+	Cancelled  *cancellation `json:"cancelled,omitempty"`
+	Duration   float64       `json:"duration_seconds"`
+}
+
+func newRunLogEntry(started time.Time, report *runReport) runLogEntry {
+	return runLogEntry{
+		Time:       started,
+		Root:       report.Root,
+		Version:    report.Version,
+		DryRun:     arg.DryRun,
+		Deleted:    len(report.Deleted),
+		Downloaded: len(report.Downloaded),
+		Failed:     report.Failed,
+		Aborted:    report.Aborted,
+		Cancelled:  report.cancellation(),
+		Duration:   time.Since(started).Seconds(),
+	}
+}
+
+// appendRunLog appends entry as a line of JSON to the run log in dir,
+// rotating the log once it grows beyond runLogMaxSize.
+func appendRunLog(dir string, entry runLogEntry) error {
+	runLogMu.Lock()
+	defer runLogMu.Unlock()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(dir, runLogName)
+	if info, err := os.Stat(fileName); err == nil && info.Size()+int64(len(data)) > runLogMaxSize {
+		if err := rotateRunLog(fileName); err != nil {
+			return err
+		}
+	}
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeAll(f, append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// rotateRunLog shifts runs.log to runs.log.1, runs.log.1 to runs.log.2 and
+// so on, dropping the oldest.
+func rotateRunLog(fileName string) error {
+	for i := runLogMaxFiles - 1; i >= 1; i-- {
+		from := fileName
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", fileName, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", fileName, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRunLog returns the entries of the run log fileName.
+func readRunLog(t *testing.T, fileName string) []runLogEntry {
+	t.Helper()
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := []runLogEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry runLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRunAppendsToRunLog(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	for i := 0; i < 2; i++ {
+		if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := readRunLog(t, filepath.Join(settingsRoot, runLogName))
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Root != rootPath || e.Version != "1" || e.Downloaded != 1 || e.Time.IsZero() {
+		t.Errorf("first entry = %+v", e)
+	}
+	if e := entries[1]; e.Downloaded != 0 {
+		t.Errorf("second entry downloaded %d files, want 0", e.Downloaded)
+	}
+}
+
+func TestRunLogRotates(t *testing.T) {
+	setupTest(t)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, runLogName)
+	full := strings.Repeat("x", runLogMaxSize) + "\n"
+	for i := 0; i < runLogMaxFiles+1; i++ {
+		if err := os.WriteFile(fileName, []byte(full), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendRunLog(dir, runLogEntry{Version: "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries := readRunLog(t, fileName); len(entries) != 1 {
+		t.Errorf("%s has %d entries after rotating, want 1", runLogName, len(entries))
+	}
+	matches, _ := filepath.Glob(fileName + "*")
+	if len(matches) != runLogMaxFiles {
+		t.Errorf("kept %q, want %d files", matches, runLogMaxFiles)
+	}
+}
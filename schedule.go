@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// interleaveBySize orders entries alternating between the largest and the
+// smallest remaining ones, so parallel workers finish big files early while
+// small files keep progress steady, instead of all big files blocking at the
+// end of the run.
+func interleaveBySize(entries []fileEntry) []fileEntry {
+	sorted := make([]fileEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+
+	res := make([]fileEntry, 0, len(sorted))
+	for lo, hi := 0, len(sorted)-1; lo <= hi; {
+		res = append(res, sorted[lo])
+		lo++
+		if lo <= hi {
+			res = append(res, sorted[hi])
+			hi--
+		}
+	}
+	return res
+}
+
+// deferLargeDownloads returns needed without the entries larger than limit,
+// which are recorded as deferred in report. Entries of unknown size are kept.
+func deferLargeDownloads(needed []fileEntry, limit uint64, report *runReport) []fileEntry {
+	res := []fileEntry{}
+	for _, dl := range needed {
+		if uint64(dl.Size) > limit {
+			fmt.Fprintf(stdout, "Deferring %s (%s)\n", dl.Name, formatBytes(int64(dl.Size)))
+			report.addDeferred(dl.Name)
+			continue
+		}
+		res = append(res, dl)
+	}
+	return res
+}
+
+// byteBudget limits the total size of the downloads started in a run, for
+// --max-total-bytes. A limit of 0 is unlimited.
+type byteBudget struct {
+	limit uint64
+
+	mu   sync.Mutex
+	used uint64
+}
+
+// reserve reports whether a download of size bytes fits in the budget,
+// reserving them if so.
+func (b *byteBudget) reserve(size uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// add counts size bytes downloaded without a reservation.
+func (b *byteBudget) add(size uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += size
+}
+
+var downloadBudget = &byteBudget{}
+
+// scheduleDownloads orders the needed downloads so that files missing from
+// rootPath come before outdated ones, getting the install to a runnable
+// state sooner. With parallel workers, each group is interleaved by size.
+func scheduleDownloads(rootPath string, needed []fileEntry) []fileEntry {
+	missing, outdated := []fileEntry{}, []fileEntry{}
+	for _, dl := range needed {
+		if storage.Exists(filepath.Join(rootPath, dl.Name)) {
+			outdated = append(outdated, dl)
+		} else {
+			missing = append(missing, dl)
+		}
+	}
+	if arg.Workers > 1 {
+		missing, outdated = interleaveBySize(missing), interleaveBySize(outdated)
+	}
+	return append(missing, outdated...)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// workerTotals simulates workers taking the next entry of queue whenever
+// they are done, with a download time proportional to the size, returning
+// the bytes each worker downloaded.
+func workerTotals(queue []fileEntry, workers int) []uint {
+	totals := make([]uint, workers)
+	for _, dl := range queue {
+		next := 0
+		for i, total := range totals {
+			if total < totals[next] {
+				next = i
+			}
+		}
+		totals[next] += dl.Size
+	}
+	return totals
+}
+
+func TestInterleaveBySizeBalancesWorkers(t *testing.T) {
+	entries := []fileEntry{}
+	for i := 0; i < 60; i++ {
+		entries = append(entries, fileEntry{Name: fmt.Sprintf("small%d", i), Size: uint(1000 + i*37%500)})
+	}
+	for i := 0; i < 6; i++ {
+		entries = append(entries, fileEntry{Name: fmt.Sprintf("large%d", i), Size: uint(8000 + i*1000)})
+	}
+	const workers = 4
+	queue := interleaveBySize(entries)
+	if len(queue) != len(entries) {
+		t.Fatalf("got %d entries, want %d", len(queue), len(entries))
+	}
+
+	totals := workerTotals(queue, workers)
+	var sum, max uint
+	for _, total := range totals {
+		sum += total
+		if total > max {
+			max = total
+		}
+	}
+	// the run takes as long as the busiest worker
+	mean := sum / workers
+	if max > mean+mean/10 {
+		t.Errorf("per worker bytes %v, busiest is more than 10%% above the mean of %d", totals, mean)
+	}
+}
+
+func TestScheduleDownloadsMissingFirst(t *testing.T) {
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"outdated.txt": "old"})
+	setupTest(t, "--workers", "1")
+	needed := []fileEntry{{Name: "outdated.txt", Size: 10}, {Name: "missing.txt", Size: 5}}
+	queue := scheduleDownloads(rootPath, needed)
+	if queue[0].Name != "missing.txt" || queue[1].Name != "outdated.txt" {
+		t.Errorf("scheduleDownloads() = %v, want missing.txt first", queue)
+	}
+}
+
+func TestMissingFilesDownloadedFirst(t *testing.T) {
+	files := map[string]string{}
+	local := map[string]string{}
+	for i := 0; i < 4; i++ {
+		files[fmt.Sprintf("outdated%d.txt", i)] = strings.Repeat("new", 10*(i+1))
+		local[fmt.Sprintf("outdated%d.txt", i)] = "old"
+		files[fmt.Sprintf("missing%d.txt", i)] = strings.Repeat("m", i+1)
+	}
+	srv := newTestServer(t, files)
+	var mu sync.Mutex
+	requested := []string{}
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := strings.TrimPrefix(r.URL.Path, "/files/"); name != r.URL.Path {
+			mu.Lock()
+			requested = append(requested, name)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, local)
+	setupTest(t, srv.patchArgs(rootPath, "--workers", "1")...)
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 8 {
+		t.Fatalf("requested %q, want all 8 files", requested)
+	}
+	for i, name := range requested {
+		if missing := strings.HasPrefix(name, "missing"); missing != (i < 4) {
+			t.Errorf("requested %q, want the missing files first", requested)
+			break
+		}
+	}
+}
+
+func TestSkipLargerThanDefersDownloads(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"small.txt": "small", "large.bin": strings.Repeat("x", 2000), "unknown.bin": strings.Repeat("y", 2000)})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		for i := range list.Downloads {
+			if list.Downloads[i].Name == "unknown.bin" {
+				list.Downloads[i].Size = 0
+			}
+		}
+	})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--skip-larger-than", "1K")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.PrintSummary()
+	if len(report.Deferred) != 1 || report.Deferred[0] != "large.bin" {
+		t.Errorf("deferred = %q, want large.bin", report.Deferred)
+	}
+	if srv.requestCount("/files/large.bin") != 0 || readTestFile(t, rootPath, "large.bin") != "<missing>" {
+		t.Error("large.bin was downloaded")
+	}
+	// files of unknown size can't be judged
+	if readTestFile(t, rootPath, "small.txt") != "small" || readTestFile(t, rootPath, "unknown.bin") == "<missing>" {
+		t.Error("the other files were not downloaded")
+	}
+	if !strings.Contains(out.String(), "1 files were deferred to a later run") {
+		t.Errorf("deferred file not counted in the summary:\n%s", out)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byteSize
+	}{
+		{"1000", 1000},
+		{"1K", 1 << 10},
+		{"500M", 500 << 20},
+		{"2GiB", 2 << 30},
+		{" 3mb ", 3 << 20},
+	}
+	for _, test := range tests {
+		var got byteSize
+		if err := got.UnmarshalText([]byte(test.in)); err != nil || got != test.want {
+			t.Errorf("%q: got %d, %v, want %d", test.in, got, err, test.want)
+		}
+	}
+	for _, in := range []string{"", "M", "-1K", "1T", "1.5G"} {
+		var got byteSize
+		if err := got.UnmarshalText([]byte(in)); err == nil {
+			t.Errorf("%q: got %d, want an error", in, got)
+		}
+	}
+}
+
+func TestMaxTotalBytesStopsNearCap(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("file%d.bin", i)] = strings.Repeat(fmt.Sprint(i), 100)
+	}
+	srv := newTestServer(t, files)
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--max-total-bytes", "350", "--workers", "4")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != 3 || len(report.Deferred) != 7 {
+		t.Errorf("%d downloaded and %d deferred, want 3 and 7", len(report.Downloaded), len(report.Deferred))
+	}
+	requested := 0
+	for name := range files {
+		requested += srv.requestCount("/files/" + name)
+	}
+	if requested != 3 {
+		t.Errorf("%d files requested, want 3", requested)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	b := &byteBudget{limit: 1000}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.reserve(30) {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 33 {
+		t.Errorf("%d reservations of 30 bytes fit in 1000, want 33", reserved)
+	}
+	if !b.reserve(10) || b.reserve(1) {
+		t.Error("the remaining 10 bytes are not reservable exactly")
+	}
+
+	unlimited := &byteBudget{}
+	if !unlimited.reserve(1 << 40) {
+		t.Error("a budget without limit refused a reservation")
+	}
+}
+
+func TestFilelistWithoutSizesOrDates(t *testing.T) {
+	files := map[string]string{"a.txt": "aaaaaaaa", "b.txt": "bbbbbbbb", "c.txt": "cccccccc", "empty.txt": ""}
+	srv := newTestServer(t, files)
+	// only names and hashes
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		for i := range list.Downloads {
+			list.Downloads[i] = fileEntry{Name: list.Downloads[i].Name, MD5: list.Downloads[i].MD5}
+		}
+		list.TotalSize = 999
+	})
+
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--dry-run")...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Would download a.txt (size unknown)") || !strings.Contains(out.String(), "Would download empty.txt (0 B)") {
+		t.Errorf("dry run sizes:\n%s", out)
+	}
+
+	// size limits don't apply to files of unknown size
+	out = setupTest(t, srv.patchArgs(rootPath, "--skip-larger-than", "1", "--min-speed", "1", "--segments", "4", "--since", "2020-01-01", "--include-undated")...)
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || len(report.Deferred) != 0 || len(report.Downloaded) != len(files) {
+		t.Errorf("downloaded %q, deferred %q, failed %+v", report.Downloaded, report.Deferred, report.Failed)
+	}
+	for name, content := range files {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	if strings.Contains(out.String(), "bytes, but its files add up to") {
+		t.Errorf("warned about the total size of files of unknown size:\n%s", out)
+	}
+
+	// but count towards --max-total-bytes once downloaded
+	rootPath = t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--max-total-bytes", "10", "--workers", "1")...)
+	report, err = patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || len(report.Deferred) != 1 {
+		t.Errorf("downloaded %q, deferred %q, failed %+v, want one 8 byte file deferred", report.Downloaded, report.Deferred, report.Failed)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// files smaller than this are always downloaded in one piece
+const segmentMinSize = 8 << 20
+
+var errRangesUnsupported = errors.New("server does not support range requests")
+
+// fetchSegmented downloads url of the given size as n byte ranges fetched in
+// parallel. It returns errRangesUnsupported if the server ignores ranges.
+func fetchSegmented(url string, size int64, n int) ([]byte, error) {
+	data := make([]byte, size)
+	segmentSize := (size + int64(n) - 1) / int64(n)
+
+	reporter.FetchStarted(url)
+	defer reporter.FetchDone(url)
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	unsupported := make([]bool, n)
+	for i := 0; i < n; i++ {
+		start := int64(i) * segmentSize
+		end := start + segmentSize
+		if end > size {
+			end = size
+		}
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			defer writeCrashDiagnostics()
+			errs[i] = withRetry(url, func() error {
+				err := fetchRange(url, data[start:end], start)
+				if err == errRangesUnsupported {
+					// no point in retrying, the caller falls back to a single stream
+					unsupported[i] = true
+					return nil
+				}
+				return err
+			})
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if unsupported[i] {
+			return nil, errRangesUnsupported
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// fetchRange reads len(buf) bytes of url starting at offset into buf.
+func fetchRange(url string, buf []byte, offset int64) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	client := newHTTPClient()
+	client.Timeout = fileTimeout(int64(len(buf)))
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errRangesUnsupported
+	default:
+		return &httpStatusError{"GET", url, response.StatusCode, response.Status}
+	}
+	if response.ContentLength >= 0 && response.ContentLength != int64(len(buf)) {
+		return fmt.Errorf("GET %s: got %d bytes for range at %d, expected %d", url, response.ContentLength, offset, len(buf))
+	}
+	_, err = io.ReadFull(&progressReader{r: response.Body, url: url}, buf)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSegmentedDownloadReassemblesFile(t *testing.T) {
+	data := make([]byte, segmentMinSize+1234)
+	rand.New(rand.NewSource(1)).Read(data)
+	srv := newTestServer(t, nil)
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		files["big.bin"] = data
+		list.Downloads = []fileEntry{{Name: "big.bin", MD5: md5OfData(data), Size: uint(len(data))}}
+	})
+	var mu sync.Mutex
+	ranges := 0
+	handler := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--segments", "4")...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("failed = %+v", report.Failed)
+	}
+	if got := readTestFile(t, rootPath, "big.bin"); got != string(data) {
+		t.Error("big.bin differs from the served file")
+	}
+	if ranges != 4 {
+		t.Errorf("fetched %d ranges, want 4", ranges)
+	}
+}
+
+func TestSegmentedDownloadWithoutRangeSupport(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), segmentMinSize/10+1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	setupTest(t)
+
+	if _, err := fetchSegmented(srv.URL+"/file", int64(len(data)), 4); err != errRangesUnsupported {
+		t.Fatalf("fetchSegmented() = %v, want %v", err, errRangesUnsupported)
+	}
+	arg.Segments = 4
+	got, err := fetchFromURL("file", srv.URL+"/file", uint(len(data)), false)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("fetchFromURL() = %d bytes, %v, want a fallback to a single stream", len(got), err)
+	}
+}
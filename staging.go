@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// installFile writes data to fullPath in the storage, replacing it in one
+// step. With --tmp-dir, it is first written to the run's staging dir on the
+// local disk and then moved into place.
+func (list *fileListYaml) installFile(fullPath string, data []byte) error {
+	if list.stagingDir == "" {
+		return storage.Write(fullPath, data)
+	}
+	f, err := createTemp(list.stagingDir, "*-"+filepath.Base(fullPath))
+	if err != nil {
+		return err
+	}
+	staged := f.Name()
+	f.Close()
+	if err := writeFile(staged, data); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	if err := storage.Rename(staged, fullPath); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	return nil
+}
+
+// createTemp is os.CreateTemp, but creates the file with mode 0666 before the
+// umask like os.Create, instead of 0600, as it is moved into the install.
+func createTemp(dir, pattern string) (*os.File, error) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: os.ErrExist}
+}
+
+// replaceInUse writes data to a uniquely named file next to fileName and
+// renames it over fileName, retrying while fileName is held open by another
+// program. A failed write leaves fileName as it was.
+func replaceInUse(fileName string, data []byte) error {
+	if err := mkdirAll(filepath.Dir(fileName)); err != nil {
+		return err
+	}
+	f, err := createTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*.fvpatcher-tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	if err := writeFile(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := renameInUse(tmp, fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// moveFile renames src to dst. If that fails, such as when they are on
+// different devices, src is copied to a uniquely named file next to dst,
+// which is renamed over it, and removed.
+func moveFile(src, dst string) error {
+	err := renameInUse(src, dst)
+	if err == nil {
+		return nil
+	}
+	if isFileInUse(err) {
+		return err
+	}
+	f, err := createTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.fvpatcher-tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := renameInUse(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// attempts to replace a file held open by another program, doubling the
+// wait between them from inUseRetryDelay
+const inUseAttempts = 5
+
+var inUseRetryDelay = 500 * time.Millisecond
+
+// rename is os.Rename, replaced in tests to simulate moves between devices
+var rename = os.Rename
+
+func renameInUse(src, dst string) error {
+	return retryInUse(dst, func() error { return rename(src, dst) })
+}
+
+// retryInUse calls fn, which replaces fileName, retrying while the file is
+// held open by another program, as Windows doesn't allow replacing files in
+// use.
+func retryInUse(fileName string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < inUseAttempts; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(attempt, inUseRetryDelay, inUseRetryDelay<<inUseAttempts, 0)
+			reporter.Logf("- %s is in use, please close the game and launcher. Retrying in %s", fileName, delay)
+			time.Sleep(delay)
+		}
+		if err = fn(); err == nil || !isFileInUse(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s is in use by another program, close the game and try again: %w", fileName, err)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if arg.FileMode != 0 {
+		if err := out.Chmod(os.FileMode(arg.FileMode)); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyTree copies the folder src with everything in it to dst, which must
+// not exist yet.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return mkdirAll(target)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(p, target)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simulateCrossDevice makes renames between folders fail like they do
+// between devices, so files are copied instead.
+func simulateCrossDevice(t *testing.T) {
+	rename = func(src, dst string) error {
+		if filepath.Dir(src) != filepath.Dir(dst) {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: errors.New("invalid cross-device link")}
+		}
+		return os.Rename(src, dst)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+func TestStagedDownloads(t *testing.T) {
+	for _, crossDevice := range []bool{false, true} {
+		if crossDevice {
+			simulateCrossDevice(t)
+		}
+		srv := newTestServer(t, map[string]string{"a.txt": "new a", "sub/b.txt": "b", "bad.txt": "bad"})
+		srv.update(func(_ *fileListYaml, files map[string][]byte) { delete(files, "bad.txt") })
+		rootPath, tmpDir := t.TempDir(), t.TempDir()
+		writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a"})
+		setupTest(t, srv.patchArgs(rootPath, "--tmp-dir", tmpDir)...)
+
+		report, err := patchRoot(rootPath, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Failed) != 1 || report.Failed[0].Name != "bad.txt" {
+			t.Errorf("cross device %v: failed = %+v, want only bad.txt", crossDevice, report.Failed)
+		}
+		for name, want := range map[string]string{"a.txt": "new a", "sub/b.txt": "b", "bad.txt": "<missing>"} {
+			if got := readTestFile(t, rootPath, name); got != want {
+				t.Errorf("cross device %v: %s = %q, want %q", crossDevice, name, got, want)
+			}
+		}
+		if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+			t.Errorf("cross device %v: %d entries left in the temp dir", crossDevice, len(entries))
+		}
+		for _, dir := range []string{rootPath, filepath.Join(rootPath, "sub")} {
+			if matches, _ := filepath.Glob(filepath.Join(dir, ".*.fvpatcher-tmp")); len(matches) != 0 {
+				t.Errorf("cross device %v: temporary files left behind: %v", crossDevice, matches)
+			}
+		}
+	}
+}
+
+func TestInstallFileReplacesInOneStep(t *testing.T) {
+	setupTest(t)
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a"})
+	fullPath := filepath.Join(rootPath, "a.txt")
+	renames := 0
+	rename = func(src, dst string) error {
+		renames++
+		if filepath.Dir(src) != rootPath || dst != fullPath {
+			t.Errorf("renamed %s to %s, want a file next to %s", src, dst, fullPath)
+		}
+		if data, _ := os.ReadFile(src); string(data) != "new a" {
+			t.Errorf("%s = %q when renamed, want it written in full", src, data)
+		}
+		if got := readTestFile(t, rootPath, "a.txt"); got != "old a" {
+			t.Errorf("a.txt = %q before the rename, want it untouched", got)
+		}
+		return os.Rename(src, dst)
+	}
+	t.Cleanup(func() { rename = os.Rename })
+
+	if err := (&fileListYaml{}).installFile(fullPath, []byte("new a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, rootPath, "a.txt"); got != "new a" || renames != 1 {
+		t.Errorf("a.txt = %q after %d renames, want %q after 1", got, renames, "new a")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(rootPath, ".*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestConcurrentMovesDontCollide(t *testing.T) {
+	setupTest(t)
+	simulateCrossDevice(t)
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+
+	// names that map to the same temporary file name pattern
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("%d", i))
+		if err := os.WriteFile(src, []byte(fmt.Sprint("content ", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dstDir, fmt.Sprintf("file%d.txt", i%5))
+		if i%5 == 0 {
+			dst = filepath.Join(dstDir, fmt.Sprintf("unique%d.txt", i))
+		}
+		wg.Add(1)
+		go func(i int, src, dst string) {
+			defer wg.Done()
+			errs[i] = moveFile(src, dst)
+		}(i, src, dst)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("move %d: %v", i, err)
+		}
+	}
+	for i := 0; i < n; i += 5 {
+		if got, want := readTestFile(t, dstDir, fmt.Sprintf("unique%d.txt", i)), fmt.Sprint("content ", i); got != want {
+			t.Errorf("unique%d.txt = %q, want %q", i, got, want)
+		}
+	}
+	// files moved to the same destination are whole copies of one of them
+	for i := 1; i < 5; i++ {
+		if got := readTestFile(t, dstDir, fmt.Sprintf("file%d.txt", i)); !strings.HasPrefix(got, "content ") || strings.Count(got, "content") != 1 {
+			t.Errorf("file%d.txt = %q", i, got)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dstDir, ".*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+	if entries, _ := os.ReadDir(srcDir); len(entries) != 0 {
+		t.Errorf("%d sources left behind", len(entries))
+	}
+
+	// and on failure
+	if err := moveFile(filepath.Join(srcDir, "missing"), filepath.Join(dstDir, "missing.txt")); err == nil {
+		t.Error("moving a missing file succeeded")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dstDir, ".*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind after a failure: %v", matches)
+	}
+}
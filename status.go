@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runCheckCommand runs the status, list-outdated or verify-file command,
+// which print their results to out. Everything else is only printed with
+// --verbose. It returns the exit code of the command, or an error if its
+// root folder is not usable.
+func runCheckCommand(command string, out io.Writer) (int, error) {
+	switch {
+	case !arg.Verbose:
+		stdout = io.Discard
+	case command == "list-outdated":
+		// only the names go to stdout, for scripts
+		stdout = os.Stderr
+	}
+	rootPath := arg.Status.EverquestRoot
+	switch command {
+	case "list-outdated":
+		rootPath = arg.ListOutdated.EverquestRoot
+	case "verify-file":
+		rootPath = arg.VerifyFile.EverquestRoot
+	}
+	var roots []string
+	if rootPath != "" {
+		roots = []string{rootPath}
+	}
+	roots, err := rootsOrEnv(roots)
+	if err != nil {
+		return 0, err
+	}
+	rootPath, err = normalizeRoot(roots[0])
+	if err != nil {
+		return 0, err
+	}
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2, nil
+	}
+	switch command {
+	case "list-outdated":
+		return list.listOutdated(out, rootPath, arg.ListOutdated.JSON), nil
+	case "verify-file":
+		return list.verifyFile(out, rootPath, arg.VerifyFile.File), nil
+	}
+	return list.Status(rootPath), nil
+}
+
+// Status checks rootPath against the manifest without modifying anything,
+// returning the exit code of the status command: 0 if the install is
+// current, 1 if it is not and 2 if it couldn't be checked.
+func (list *fileListYaml) Status(rootPath string) int {
+	report := newRunReport(rootPath, list.Version)
+	pending := 0
+	for _, del := range list.expandDeletes(rootPath, report) {
+		if storage.Exists(filepath.Join(rootPath, del.Name)) && !keepModified(rootPath, del) {
+			fmt.Fprintln(stdout, "Needs delete:", del.Name)
+			pending++
+		}
+	}
+	for _, dl := range list.outdatedDownloads(rootPath, report) {
+		fmt.Fprintln(stdout, "Needs download:", dl.Name)
+		pending++
+	}
+
+	if len(report.Failed) > 0 {
+		for _, f := range report.Failed {
+			fmt.Fprintln(os.Stderr, "ERROR:", f.Name+":", f.Error)
+		}
+		return 2
+	}
+	if pending > 0 {
+		fmt.Fprintf(stdout, "Install is not current, %d changes pending\n", pending)
+		return 1
+	}
+	fmt.Fprintln(stdout, "Install is current with version", list.Version)
+	return 0
+}
+
+// listOutdated prints the names of the downloads that are missing or differ
+// locally to w, one per line or as a JSON array. It returns the exit
+// code of the list-outdated command: 0, or 2 if the install couldn't be
+// checked.
+func (list *fileListYaml) listOutdated(w io.Writer, rootPath string, asJSON bool) int {
+	report := newRunReport(rootPath, list.Version)
+	names := []string{}
+	for _, dl := range list.outdatedDownloads(rootPath, report) {
+		names = append(names, dl.Name)
+	}
+	if len(report.Failed) > 0 {
+		for _, f := range report.Failed {
+			fmt.Fprintln(os.Stderr, "ERROR:", f.Name+":", f.Error)
+		}
+		return 2
+	}
+	if asJSON {
+		data, err := json.Marshal(names)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			return 2
+		}
+		fmt.Fprintln(w, string(data))
+		return 0
+	}
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+	return 0
+}
+
+type verifyFileCmd struct {
+	EverquestRoot string `arg:"" help:"Root folder of the install." type:"existingdir"`
+	File          string `arg:"" help:"File in the install to check." type:"existingfile"`
+}
+
+// verifyFile prints whether fileName in rootPath matches its filelist entry
+// to w, returning the exit code of the verify-file command: 0 if it matches, 1 if
+// it differs or isn't in the filelist and 2 if it couldn't be checked.
+func (list *fileListYaml) verifyFile(w io.Writer, rootPath, fileName string) int {
+	abs, err := filepath.Abs(fileName)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2
+	}
+	rel, err := filepath.Rel(rootPath, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		fmt.Fprintln(os.Stderr, "ERROR:", fileName, "is not in", rootPath)
+		return 2
+	}
+	name := filepath.ToSlash(rel)
+	for _, dl := range list.Downloads {
+		if dl.Name != name {
+			continue
+		}
+		actualMD5, _, err := storage.Hash(abs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			return 2
+		}
+		if actualMD5 != dl.MD5 {
+			fmt.Fprintln(w, "MISMATCH", name+":", &hashMismatchError{Expected: dl.MD5, Actual: actualMD5})
+			return 1
+		}
+		fmt.Fprintln(w, "OK", name)
+		return 0
+	}
+	fmt.Fprintln(w, "NOT IN MANIFEST", name)
+	return 1
+}
+
+// currentBySize counts the downloads whose local file exists with the
+// expected size, a quick estimate of how current the install is made
+// without hashing anything.
+func (list *fileListYaml) currentBySize(rootPath string) int {
+	current := 0
+	for _, dl := range list.Downloads {
+		info, err := storage.Stat(filepath.Join(rootPath, dl.Name))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if dl.Size == 0 || info.Size() == int64(dl.Size) {
+			current++
+		}
+	}
+	return current
+}
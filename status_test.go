@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		local map[string]string
+		want  int
+	}{
+		{"current", map[string]string{"a.txt": "a", "maps/b.eqg": "b"}, 0},
+		{"missing", map[string]string{"a.txt": "a"}, 1},
+		{"outdated", map[string]string{"a.txt": "a", "maps/b.eqg": "old b"}, 1},
+		{"needs delete", map[string]string{"a.txt": "a", "maps/b.eqg": "b", "removed.txt": "x"}, 1},
+	}
+	for _, tt := range tests {
+		srv := newTestServer(t, map[string]string{"a.txt": "a", "maps/b.eqg": "b"})
+		srv.update(func(list *fileListYaml, _ map[string][]byte) {
+			list.Deletes = []fileEntry{{Name: "removed.txt"}}
+		})
+		rootPath := t.TempDir()
+		writeTestFiles(t, rootPath, tt.local)
+		args := srv.patchArgs(rootPath)
+		args[0] = "status"
+		setupTest(t, args...)
+
+		list, err := loadFileList(rootPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list.Status(rootPath); got != tt.want {
+			t.Errorf("%s: Status() = %d, want %d", tt.name, got, tt.want)
+		}
+		// nothing was changed
+		for name, content := range tt.local {
+			if got := readTestFile(t, rootPath, name); got != content {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, content)
+			}
+		}
+	}
+}
+
+func TestCurrentBySize(t *testing.T) {
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{
+		"same.txt":     "same",
+		"resized.txt":  "longer than before",
+		"unknown.txt":  "any size",
+		"folder/x.txt": "x",
+	})
+	list := fileListYaml{Downloads: []fileEntry{
+		{Name: "same.txt", Size: 4},
+		{Name: "resized.txt", Size: 7},
+		{Name: "unknown.txt"},
+		{Name: "missing.txt", Size: 3},
+		{Name: "folder", Size: 1},
+	}}
+	if got := list.currentBySize(rootPath); got != 2 {
+		t.Errorf("currentBySize() = %d, want 2", got)
+	}
+
+	srv := newTestServer(t, map[string]string{"same.txt": "same", "resized.txt": "resized", "missing.txt": "new"})
+	out := setupTest(t, srv.patchArgs(rootPath)...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "1 of 3 files current\n") {
+		t.Errorf("upfront status not printed:\n%s", out)
+	}
+}
+
+func TestListOutdated(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b", "maps/c.eqg": "c", "maps/d.eqg": "d"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "removed.txt"}} })
+	rootPath := t.TempDir()
+	local := map[string]string{"a.txt": "a", "b.txt": "old b", "maps/d.eqg": "d", "removed.txt": "x"}
+	writeTestFiles(t, rootPath, local)
+	args := srv.patchArgs(rootPath)
+	args[0] = "list-outdated"
+
+	for _, asJSON := range []bool{false, true} {
+		setupTest(t, args...)
+		arg.ListOutdated.JSON = asJSON
+		out := &strings.Builder{}
+		code, err := runCheckCommand("list-outdated", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 0 {
+			t.Errorf("list-outdated = %d, want 0", code)
+		}
+		want := "b.txt\nmaps/c.eqg\n"
+		if asJSON {
+			want = `["b.txt","maps/c.eqg"]` + "\n"
+		}
+		if out.String() != want {
+			t.Errorf("list-outdated with JSON %v printed %q, want %q", asJSON, out, want)
+		}
+		if stdout != io.Discard {
+			t.Error("list-outdated shows the progress without --verbose")
+		}
+	}
+	// nothing was changed
+	for name, content := range local {
+		if got := readTestFile(t, rootPath, name); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "maps/b.eqg": "b"})
+	// as main normalizes it
+	rootPath, err := normalizeRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "a", "maps/b.eqg": "old b", "extra.txt": "extra"})
+	outside := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(outside, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fileName string
+		code     int
+		want     string
+	}{
+		{filepath.Join(rootPath, "a.txt"), 0, "OK a.txt"},
+		{filepath.Join(rootPath, "maps", "b.eqg"), 1, "MISMATCH maps/b.eqg: got MD5 " + md5Hex("old b") + ", expected " + md5Hex("b")},
+		{filepath.Join(rootPath, "extra.txt"), 1, "NOT IN MANIFEST extra.txt"},
+		{outside, 2, ""},
+		{rootPath, 2, ""},
+		{filepath.Dir(rootPath), 2, ""},
+	}
+	for _, tt := range tests {
+		// folders are refused when parsing the arguments, so they are set
+		// directly to reach the checks of verifyFile
+		args := []string{"verify-file", rootPath, outside}
+		setupTest(t, append(args, srv.patchArgs(rootPath)[2:]...)...)
+		arg.VerifyFile.File = tt.fileName
+		out := &strings.Builder{}
+		code, err := runCheckCommand("verify-file", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("verify-file %s = %d, want %d", tt.fileName, code, tt.code)
+		}
+		if got := strings.TrimSpace(out.String()); got != tt.want {
+			t.Errorf("verify-file %s printed %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage holds the files of the install being patched, which the handlers
+// read, hash, write and remove through it. Names are full paths below the
+// install root. Only fvpatcher's own files, such as the staging folder of
+// --tmp-dir and the trash of --delete-to-trash, are on the local disk.
+type Storage interface {
+	Exists(fileName string) bool
+
+	Open(fileName string) (io.ReadCloser, error)
+
+	Stat(fileName string) (fs.FileInfo, error)
+
+	// ReadDir returns the entries of the folder dirName, sorted by name.
+	ReadDir(dirName string) ([]fs.DirEntry, error)
+
+	// Hash returns the MD5 and size of fileName.
+	Hash(fileName string) (string, int64, error)
+
+	// Write replaces fileName with data in one step, creating its folder if
+	// needed.
+	Write(fileName string, data []byte) error
+
+	Remove(fileName string) error
+
+	// RemoveAll removes fileName and, if it is a folder, everything in it.
+	RemoveAll(fileName string) error
+
+	// Rename moves the local file src over fileName, creating its folder if
+	// needed.
+	Rename(src, fileName string) error
+
+	// MoveOut moves fileName, a file or folder, to the local path dst, whose
+	// folder must exist.
+	MoveOut(fileName, dst string) error
+}
+
+var storage Storage = osStorage{}
+
+// osStorage is the local filesystem.
+type osStorage struct{}
+
+func (osStorage) Exists(fileName string) bool                   { return fileOrDirExists(fileName) }
+func (osStorage) Open(fileName string) (io.ReadCloser, error)   { return os.Open(fileName) }
+func (osStorage) Stat(fileName string) (fs.FileInfo, error)     { return os.Stat(fileName) }
+func (osStorage) ReadDir(dirName string) ([]fs.DirEntry, error) { return os.ReadDir(dirName) }
+func (osStorage) Write(fileName string, data []byte) error      { return replaceInUse(fileName, data) }
+func (osStorage) Remove(fileName string) error                  { return os.Remove(fileName) }
+func (osStorage) RemoveAll(fileName string) error               { return os.RemoveAll(fileName) }
+
+func (osStorage) Hash(fileName string) (string, int64, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	sum, err := md5OfFile(fileName)
+	return sum, info.Size(), err
+}
+
+func (osStorage) Rename(src, fileName string) error {
+	if err := mkdirAll(filepath.Dir(fileName)); err != nil {
+		return err
+	}
+	return moveFile(src, fileName)
+}
+
+func (osStorage) MoveOut(fileName, dst string) error {
+	err := rename(fileName, dst)
+	if err == nil {
+		return nil
+	}
+	info, statErr := os.Lstat(fileName)
+	if statErr != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return moveFile(fileName, dst)
+	}
+	// on another device, folders are copied and then removed
+	if err := copyTree(fileName, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(fileName)
+}
+
+// readStorageFile returns the contents of fileName in the storage.
+func readStorageFile(fileName string) ([]byte, error) {
+	f, err := storage.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// walkStorage is filepath.WalkDir of the folder root in the storage.
+func walkStorage(root string, fn fs.WalkDirFunc) error {
+	info, err := storage.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkStorageDir(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkStorageDir(p string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(p, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := storage.ReadDir(p)
+	if err != nil {
+		// the callback can decide to skip the folder or stop
+		if err = fn(p, d, err); err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := walkStorageDir(filepath.Join(p, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage keeps the install in memory.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemStorage(rootPath string, files map[string]string) *memStorage {
+	s := &memStorage{files: map[string][]byte{}}
+	for name, content := range files {
+		s.files[filepath.Join(rootPath, name)] = []byte(content)
+	}
+	return s
+}
+
+func (s *memStorage) Exists(fileName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[fileName]
+	return ok
+}
+
+func (s *memStorage) Hash(fileName string) (string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[fileName]
+	if !ok {
+		return "", 0, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+	return md5OfData(data), int64(len(data)), nil
+}
+
+func (s *memStorage) Write(fileName string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fileName] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memStorage) Remove(fileName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[fileName]; !ok {
+		return &os.PathError{Op: "remove", Path: fileName, Err: os.ErrNotExist}
+	}
+	delete(s.files, fileName)
+	return nil
+}
+
+func (s *memStorage) RemoveAll(fileName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.files {
+		if name == fileName || strings.HasPrefix(name, fileName+string(filepath.Separator)) {
+			delete(s.files, name)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Rename(src, fileName string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(fileName, data); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (s *memStorage) Open(fileName string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[fileName]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: fileName, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStorage) Stat(fileName string) (fs.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.files[fileName]; ok {
+		return memFileInfo{name: filepath.Base(fileName), size: int64(len(data))}, nil
+	}
+	for name := range s.files {
+		if strings.HasPrefix(name, fileName+string(filepath.Separator)) {
+			return memFileInfo{name: filepath.Base(fileName), dir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: fileName, Err: os.ErrNotExist}
+}
+
+func (s *memStorage) ReadDir(dirName string) ([]fs.DirEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	children := map[string]memFileInfo{}
+	for name, data := range s.files {
+		rest := strings.TrimPrefix(name, dirName+string(filepath.Separator))
+		if rest == name {
+			continue
+		}
+		if child, _, nested := strings.Cut(rest, string(filepath.Separator)); nested {
+			children[child] = memFileInfo{name: child, dir: true}
+		} else {
+			children[child] = memFileInfo{name: child, size: int64(len(data))}
+		}
+	}
+	if len(children) == 0 {
+		return nil, &os.PathError{Op: "readdir", Path: dirName, Err: os.ErrNotExist}
+	}
+	entries := []fs.DirEntry{}
+	for _, info := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *memStorage) MoveOut(fileName, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := 0
+	for name, data := range s.files {
+		if name != fileName && !strings.HasPrefix(name, fileName+string(filepath.Separator)) {
+			continue
+		}
+		if err := writeFile(dst+strings.TrimPrefix(name, fileName), data); err != nil {
+			return err
+		}
+		delete(s.files, name)
+		moved++
+	}
+	if moved == 0 {
+		return &os.LinkError{Op: "rename", Old: fileName, New: dst, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// memFileInfo describes a file or folder of a memStorage.
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() any           { return nil }
+
+func (fi memFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0777
+	}
+	return 0666
+}
+
+func TestHandlersUseStorage(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"current.txt": "current", "stale.txt": "new", "sub/added.txt": "added"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	dir := t.TempDir()
+	setupTest(t, srv.patchArgs(dir)...)
+	// the install only exists in memory
+	rootPath := filepath.Join(dir, "eq")
+	mem := newMemStorage(rootPath, map[string]string{"current.txt": "current", "stale.txt": "old", "old.txt": "old"})
+	storage = mem
+	t.Cleanup(func() { storage = osStorage{} })
+
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newRunReport(rootPath, list.Version)
+	if err := list.HandleDeleteRequests(rootPath, report); err != nil {
+		t.Fatal(err)
+	}
+	list.HandleDownloadRequests(rootPath, report)
+
+	if len(report.Failed) != 0 {
+		t.Errorf("failed: %+v", report.Failed)
+	}
+	want := map[string]string{"current.txt": "current", "stale.txt": "new", "sub/added.txt": "added"}
+	if len(mem.files) != len(want) {
+		t.Errorf("storage holds %d files, want %d", len(mem.files), len(want))
+	}
+	for name, content := range want {
+		if got := string(mem.files[filepath.Join(rootPath, name)]); got != content {
+			t.Errorf("%s is %q, want %q", name, got, content)
+		}
+	}
+	if srv.requests["/files/current.txt"] != 0 {
+		t.Error("downloaded current.txt, which was current in the storage")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files were created on disk: %v", entries)
+	}
+}
+
+func TestPatchesDuplicatesAndTrashUseStorage(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"file.txt": patchNew, "a.txt": "shared", "b.txt": "shared"})
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		files["file.txt.bsdiff"] = testPatch(t)
+		for i := range list.Downloads {
+			if list.Downloads[i].Name == "file.txt" {
+				list.Downloads[i].Patch = &filePatch{Name: "file.txt.bsdiff", SourceMD5: md5Hex(patchOld)}
+			}
+		}
+		list.Deletes = []fileEntry{{Name: "logs/*.bak", Glob: true}}
+	})
+	dir := t.TempDir()
+	trashDir := filepath.Join(t.TempDir(), "trash")
+	setupTest(t, srv.patchArgs(dir, "--delete-to-trash", "--trash-dir", trashDir)...)
+	rootPath := filepath.Join(dir, "eq")
+	mem := newMemStorage(rootPath, map[string]string{"file.txt": patchOld, "logs/old.bak": "old", "logs/keep.txt": "keep"})
+	storage = mem
+	t.Cleanup(func() { storage = osStorage{} })
+
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newRunReport(rootPath, list.Version)
+	if err := list.HandleDeleteRequests(rootPath, report); err != nil {
+		t.Fatal(err)
+	}
+	list.HandleDownloadRequests(rootPath, report)
+
+	if len(report.Failed) != 0 {
+		t.Errorf("failed: %+v", report.Failed)
+	}
+	want := map[string]string{"file.txt": patchNew, "a.txt": "shared", "b.txt": "shared", "logs/keep.txt": "keep"}
+	if len(mem.files) != len(want) {
+		t.Errorf("storage holds %d files, want %d", len(mem.files), len(want))
+	}
+	for name, content := range want {
+		if got := string(mem.files[filepath.Join(rootPath, name)]); got != content {
+			t.Errorf("%s is %q, want %q", name, got, content)
+		}
+	}
+	if n := srv.requestCount("/files/file.txt"); n != 0 {
+		t.Errorf("downloaded file.txt %d times instead of patching it", n)
+	}
+	if n := srv.requestCount("/files/a.txt") + srv.requestCount("/files/b.txt"); n != 1 {
+		t.Errorf("the shared content was requested %d times, want once", n)
+	}
+	runs, err := os.ReadDir(trashRoot())
+	if err != nil || len(runs) != 1 || readTestFile(t, filepath.Join(trashRoot(), runs[0].Name()), "logs/old.bak") != "old" {
+		t.Errorf("logs/old.bak was not moved to the trash: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files were created on disk: %v", entries)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// totalsWarnings compares the totals the filelist declares with the
+// entries it lists and the files in rootPath, describing each mismatch.
+func (list *fileListYaml) totalsWarnings(rootPath string) []string {
+	if list.TotalFiles == 0 && list.TotalSize == 0 {
+		return nil
+	}
+	var listedSize, localSize uint64
+	localFiles := 0
+	sizesKnown := true
+	for _, dl := range list.allDownloads {
+		listedSize += uint64(dl.Size)
+		if dl.Size == 0 && dl.MD5 != emptyMD5 {
+			sizesKnown = false
+		}
+		if info, err := storage.Stat(filepath.Join(rootPath, dl.Name)); err == nil && !info.IsDir() {
+			localFiles++
+			localSize += uint64(info.Size())
+		}
+	}
+	warnings := []string{}
+	if list.TotalFiles != 0 && list.TotalFiles != len(list.allDownloads) {
+		warnings = append(warnings, fmt.Sprintf("filelist declares %d files, but lists %d", list.TotalFiles, len(list.allDownloads)))
+	}
+	if list.TotalSize != 0 && sizesKnown && list.TotalSize != listedSize {
+		warnings = append(warnings, fmt.Sprintf("filelist declares %d bytes, but its files add up to %d", list.TotalSize, listedSize))
+	}
+	if list.TotalFiles != 0 && localFiles != list.TotalFiles {
+		warnings = append(warnings, fmt.Sprintf("install has %d of the %d files the filelist declares", localFiles, list.TotalFiles))
+	}
+	if list.TotalSize != 0 && localSize != list.TotalSize {
+		warnings = append(warnings, fmt.Sprintf("install has %s of the %s the filelist declares", formatBytes(int64(localSize)), formatBytes(int64(list.TotalSize))))
+	}
+	return warnings
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotalsMismatchIsReported(t *testing.T) {
+	tests := []struct {
+		files    int
+		size     uint64
+		warnings []string
+	}{
+		{2, 5, nil},
+		{3, 5, []string{"filelist declares 3 files, but lists 2", "install has 2 of the 3 files the filelist declares"}},
+		{2, 9, []string{"filelist declares 9 bytes, but its files add up to 5", "install has 5 B of the 9 B the filelist declares"}},
+	}
+	for _, test := range tests {
+		srv := newTestServer(t, map[string]string{"a.txt": "aa", "b.txt": "bbb"})
+		srv.update(func(list *fileListYaml, _ map[string][]byte) {
+			list.TotalFiles, list.TotalSize = test.files, test.size
+		})
+		rootPath := t.TempDir()
+		out := setupTest(t, srv.patchArgs(rootPath)...)
+
+		if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, warning := range test.warnings {
+			if !strings.Contains(out.String(), "WARNING: "+warning+"\n") {
+				t.Errorf("declaring %d files of %d bytes: missing warning %q in:\n%s", test.files, test.size, warning, out)
+			}
+		}
+		if n := strings.Count(out.String(), "WARNING: "); n != len(test.warnings) {
+			t.Errorf("declaring %d files of %d bytes: %d warnings, want %d:\n%s", test.files, test.size, n, len(test.warnings), out)
+		}
+	}
+}
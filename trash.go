@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type trashCmd struct {
+	Empty trashEmptyCmd `cmd:"" help:"Permanently remove the files moved to the trash by --delete-to-trash."`
+}
+
+type trashEmptyCmd struct {
+	OlderThan time.Duration `help:"Only remove files trashed longer ago than this."`
+}
+
+// files deleted in this run are moved to a folder named after the time the
+// run started
+var trashRunStarted = time.Now()
+
+// trashRoot returns the folder holding the trashed runs. Below --trash-dir,
+// they are kept in a folder of their own, as emptying the trash removes
+// everything in it.
+func trashRoot() string {
+	if arg.TrashDir != "" {
+		return filepath.Join(arg.TrashDir, "fvpatcher-trash")
+	}
+	return filepath.Join(getSettingsRoot(), "trash")
+}
+
+// moveToTrash moves name in rootPath to the trash, keeping its path relative
+// to the root so it can be restored by moving it back.
+func moveToTrash(rootPath, name string) error {
+	runDir := trashRunStarted.Format("20060102-150405") + "-" + filepath.Base(rootPath)
+	dst := filepath.Join(trashRoot(), runDir, name)
+	if err := mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return storage.MoveOut(filepath.Join(rootPath, name), dst)
+}
+
+// emptyTrash removes the trashed runs older than olderThan, or all of them.
+func emptyTrash(olderThan time.Duration) error {
+	entries, err := os.ReadDir(trashRoot())
+	if os.IsNotExist(err) {
+		fmt.Fprintln(stdout, "The trash is empty")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if olderThan > 0 && time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(trashRoot(), entry.Name())); err != nil {
+			return err
+		}
+		removed++
+	}
+	fmt.Fprintf(stdout, "Removed %d of %d runs from %s\n", removed, len(entries), trashRoot())
+	return nil
+}
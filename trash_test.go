@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteToTrash(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "old.txt"}, {Name: "sub/old.dat"}}
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"old.txt": "old", "sub/old.dat": "old data"})
+	before, err := os.Stat(filepath.Join(rootPath, "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userDir := t.TempDir()
+	writeTestFiles(t, userDir, map[string]string{"mine.txt": "mine"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--delete-to-trash", "--trash-dir", userDir)...)
+	trashDir := filepath.Join(userDir, "fvpatcher-trash")
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 2 || readTestFile(t, rootPath, "old.txt") != "<missing>" {
+		t.Fatalf("deleted = %q", report.Deleted)
+	}
+	runs, err := os.ReadDir(trashDir)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("trash has %d runs, %v, want 1", len(runs), err)
+	}
+	runDir := filepath.Join(trashDir, runs[0].Name())
+	if readTestFile(t, runDir, "old.txt") != "old" || readTestFile(t, runDir, "sub/old.dat") != "old data" {
+		t.Error("trashed files are missing or changed")
+	}
+	// on the same filesystem, files are moved instead of copied
+	if after, err := os.Stat(filepath.Join(runDir, "old.txt")); err != nil || !os.SameFile(before, after) {
+		t.Errorf("old.txt was copied to the trash, %v", err)
+	}
+
+	// and can be restored by moving them back
+	if err := os.Rename(filepath.Join(runDir, "old.txt"), filepath.Join(rootPath, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, rootPath, "old.txt") != "old" {
+		t.Error("old.txt was not restored")
+	}
+
+	if err := emptyTrash(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(runDir); err != nil {
+		t.Errorf("emptying runs older than an hour removed the current one: %v", err)
+	}
+	if err := emptyTrash(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(runDir); !os.IsNotExist(err) {
+		t.Errorf("the trash was not emptied: %v", err)
+	}
+	if !strings.Contains(out.String(), "Removed 1 of 1 runs") {
+		t.Errorf("emptying not reported:\n%s", out)
+	}
+	// other files in --trash-dir are left alone
+	if got := readTestFile(t, userDir, "mine.txt"); got != "mine" {
+		t.Errorf("mine.txt = %q after emptying the trash", got)
+	}
+}
+
+func TestTrashInSettingsDir(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"old.txt": "old"})
+	setupTest(t, srv.patchArgs(rootPath, "--delete-to-trash")...)
+	settings := settingsRoot
+
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	trashDir := filepath.Join(settings, "trash")
+	runs, err := os.ReadDir(trashDir)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("%s has %d runs, %v, want 1", trashDir, len(runs), err)
+	}
+	if got := readTestFile(t, filepath.Join(trashDir, runs[0].Name()), "old.txt"); got != "old" {
+		t.Errorf("trashed old.txt = %q", got)
+	}
+
+	// trash empty --older-than keeps recent runs
+	old := filepath.Join(trashDir, "20200101-000000-eq")
+	writeTestFiles(t, old, map[string]string{"older.txt": "older"})
+	longAgo := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, longAgo, longAgo); err != nil {
+		t.Fatal(err)
+	}
+	out := setupTest(t, "trash", "empty", "--older-than", "24h")
+	settingsRoot = settings
+	if err := emptyTrash(arg.Trash.Empty.OlderThan); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("the old run was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(trashDir, runs[0].Name())); err != nil {
+		t.Errorf("the recent run was removed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Removed 1 of 2 runs") {
+		t.Errorf("emptying not reported:\n%s", out)
+	}
+}
+
+func TestTrashFolderAcrossDevices(t *testing.T) {
+	setupTest(t, "--delete-to-trash", "--trash-dir", t.TempDir())
+	simulateCrossDevice(t)
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"uifiles/oldskin/a.tga": "a", "uifiles/oldskin/sub/b.xml": "b"})
+
+	if err := moveToTrash(rootPath, "uifiles/oldskin"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(filepath.Join(rootPath, "uifiles", "oldskin")) {
+		t.Error("uifiles/oldskin is still in the install")
+	}
+	runs, err := os.ReadDir(trashRoot())
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("trash has %d runs, %v, want 1", len(runs), err)
+	}
+	runDir := filepath.Join(trashRoot(), runs[0].Name())
+	if readTestFile(t, runDir, "uifiles/oldskin/a.tga") != "a" || readTestFile(t, runDir, "uifiles/oldskin/sub/b.xml") != "b" {
+		t.Error("the trashed folder is missing files")
+	}
+}
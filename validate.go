@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Validate checks the whole manifest before anything is changed, returning a
+// description of each problem found.
+func (list *fileListYaml) Validate() []string {
+	problems := []string{}
+	if list.Version == "" {
+		problems = append(problems, "missing Version")
+	}
+	if arg.SourceDir == "" {
+		if u, err := url.Parse(list.DownloadPrefix); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("invalid DownloadPrefix %q", list.DownloadPrefix))
+		}
+	}
+	for i, del := range list.Deletes {
+		var err error
+		if del.Glob {
+			err = validateDeletePattern(del.Name)
+		} else {
+			err = validateEntryName(del.Name)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("delete #%d: %v", i+1, err))
+		}
+		if del.MD5 != "" && !isMD5(del.MD5) {
+			problems = append(problems, fmt.Sprintf("delete #%d %q: invalid MD5 %q", i+1, del.Name, del.MD5))
+		}
+	}
+	for i, dl := range list.Downloads {
+		if err := validateEntryName(dl.Name); err != nil {
+			problems = append(problems, fmt.Sprintf("download #%d: %v", i+1, err))
+		}
+		if !isMD5(dl.MD5) {
+			problems = append(problems, fmt.Sprintf("download #%d %q: invalid MD5 %q", i+1, dl.Name, dl.MD5))
+		}
+		if dl.URL != "" {
+			if u, err := url.Parse(dl.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("download #%d %q: invalid URL %q", i+1, dl.Name, dl.URL))
+			}
+		}
+		if dl.Compression != "" && dl.Compression != compressionZstd {
+			problems = append(problems, fmt.Sprintf("download #%d %q: unsupported Compression %q", i+1, dl.Name, dl.Compression))
+		}
+		if dl.Patch != nil {
+			if err := validateEntryName(dl.Patch.Name); err != nil {
+				problems = append(problems, fmt.Sprintf("download #%d %q: patch: %v", i+1, dl.Name, err))
+			}
+			if !isMD5(dl.Patch.SourceMD5) {
+				problems = append(problems, fmt.Sprintf("download #%d %q: patch: invalid SourceMD5 %q", i+1, dl.Name, dl.Patch.SourceMD5))
+			}
+		}
+	}
+	return problems
+}
+
+// entries larger than this are assumed to have a mistaken Size, as no game
+// file comes close
+const maxPlausibleSize = 4 << 30
+
+// sizeWarnings describes downloads with an implausible Size, which is in
+// bytes.
+func (list *fileListYaml) sizeWarnings() []string {
+	warnings := []string{}
+	for i, dl := range list.Downloads {
+		if uint64(dl.Size) > maxPlausibleSize {
+			warnings = append(warnings, fmt.Sprintf("download #%d %q: implausible Size %d (%s), sizes are in bytes", i+1, dl.Name, dl.Size, formatBytes(int64(dl.Size))))
+		}
+		if dl.MD5 == emptyMD5 && dl.Size != 0 {
+			warnings = append(warnings, fmt.Sprintf("download #%d %q: Size is %d, but the MD5 is that of an empty file", i+1, dl.Name, dl.Size))
+		}
+	}
+	return warnings
+}
+
+// sizeMismatchWarning describes the difference between the Size of dl and
+// the n bytes received, or returns "" if they agree or Size is unknown.
+func sizeMismatchWarning(dl fileEntry, n int) string {
+	if dl.Size == 0 || uint(n) == dl.Size {
+		return ""
+	}
+	msg := fmt.Sprintf("%s is %d bytes, but the filelist says %d", dl.Name, n, dl.Size)
+	if uint(n)/1024 == dl.Size || uint(n)/1000 == dl.Size {
+		msg += ", the filelist seems to use kilobytes instead of bytes"
+	}
+	return msg
+}
+
+// skipUnsafeEntries returns entries without those whose Name is empty or
+// points at or outside of the root, which are never acted on, even with
+// --skip-validation. Glob entries are checked when they are expanded.
+func skipUnsafeEntries(entries []fileEntry) []fileEntry {
+	res := []fileEntry{}
+	for _, e := range entries {
+		if !e.Glob {
+			if err := validateEntryName(e.Name); err != nil {
+				fmt.Fprintln(stdout, "WARNING: skipping entry:", err)
+				continue
+			}
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// validateEntryName checks that name is a relative path inside the root.
+func validateEntryName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("empty Name")
+	}
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	clean := path.Clean(slashed)
+	if path.IsAbs(slashed) || (len(slashed) > 1 && slashed[1] == ':') {
+		return fmt.Errorf("Name %q is an absolute path", name)
+	}
+	if clean == "." {
+		return fmt.Errorf("Name %q is the root itself", name)
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("Name %q points outside of the root", name)
+	}
+	return nil
+}
+
+func isMD5(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkManifest loads and validates the filelist of rootPath and prints a
+// summary of it, without touching any game files.
+func checkManifest(rootPath string) error {
+	list, err := loadFileList(rootPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Filelist manifest version %s: %d deletes, %d downloads\n", list.Version, len(list.Deletes), len(list.Downloads))
+	if problems := list.Validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(stdout, "-", problem)
+		}
+		return fmt.Errorf("filelist failed validation with %d problems", len(problems))
+	}
+	for _, warning := range list.sizeWarnings() {
+		fmt.Fprintln(stdout, "WARNING:", warning)
+	}
+	fmt.Fprintln(stdout, "Filelist is valid")
+	return nil
+}
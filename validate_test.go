@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidManifestChangesNothing(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: "old.txt"}}
+		list.Downloads = append(list.Downloads,
+			fileEntry{Name: "../outside.txt", MD5: md5Hex("x")},
+			fileEntry{Name: "b.txt", MD5: "not an md5"})
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"old.txt": "old"})
+	out := setupTest(t, srv.patchArgs(rootPath)...)
+
+	if _, err := patchRoot(rootPath, time.Time{}); err == nil {
+		t.Fatal("patchRoot() applied an invalid filelist")
+	}
+	if !strings.Contains(out.String(), "Filelist failed validation with 2 problems") {
+		t.Errorf("problems not reported:\n%s", out)
+	}
+	if readTestFile(t, rootPath, "old.txt") != "old" || readTestFile(t, rootPath, "a.txt") != "<missing>" {
+		t.Error("the install was changed")
+	}
+
+	// unless forced, without acting on unsafe names
+	setupTest(t, srv.patchArgs(rootPath, "--skip-validation")...)
+	if _, err := patchRoot(rootPath, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, rootPath, "a.txt") != "a" || readTestFile(t, rootPath, "../outside.txt") != "<missing>" {
+		t.Error("--skip-validation did not apply only the safe entries")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := fileEntry{Name: "a.txt", MD5: md5Hex("a")}
+	tests := []struct {
+		name string
+		list fileListYaml
+		want int
+	}{
+		{"valid", fileListYaml{Version: "1", DownloadPrefix: "https://cdn.example.com/", Downloads: []fileEntry{valid}}, 0},
+		{"no version", fileListYaml{DownloadPrefix: "https://cdn.example.com/"}, 1},
+		{"relative prefix", fileListYaml{Version: "1", DownloadPrefix: "cdn.example.com/"}, 1},
+		{"unsafe names", fileListYaml{Version: "1", DownloadPrefix: "https://cdn.example.com/", Downloads: []fileEntry{
+			{Name: "/etc/passwd", MD5: valid.MD5}, {Name: `C:\Windows\win.ini`, MD5: valid.MD5}, {Name: `..\x`, MD5: valid.MD5}, {Name: " ", MD5: valid.MD5},
+		}}, 4},
+		{"bad entries", fileListYaml{Version: "1", DownloadPrefix: "https://cdn.example.com/", Deletes: []fileEntry{
+			{Name: "*", Glob: true}, {Name: "x.txt", MD5: "123"},
+		}, Downloads: []fileEntry{
+			{Name: "a.txt", MD5: strings.ToUpper(valid.MD5)},
+			{Name: "b.txt", MD5: valid.MD5, URL: "ftp://cdn.example.com/b.txt"},
+			{Name: "c.txt", MD5: valid.MD5, Compression: "gzip"},
+			{Name: "d.txt", MD5: valid.MD5, Patch: &filePatch{Name: "../d.bsdiff", SourceMD5: "x"}},
+		}}, 7},
+	}
+	setupTest(t)
+	for _, tt := range tests {
+		if problems := tt.list.Validate(); len(problems) != tt.want {
+			t.Errorf("%s: Validate() = %q, want %d problems", tt.name, problems, tt.want)
+		}
+	}
+}
+
+func TestManifestOnly(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "new a", "b.txt": "b"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Deletes = []fileEntry{{Name: "old.txt"}} })
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"a.txt": "old a", "old.txt": "old"})
+	out := setupTest(t, srv.patchArgs(rootPath, "--manifest-only")...)
+
+	if err := checkManifest(rootPath); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Filelist manifest version 1: 1 deletes, 2 downloads") {
+		t.Errorf("summary is missing or wrong:\n%s", out)
+	}
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || readTestFile(t, rootPath, "a.txt") != "old a" || readTestFile(t, rootPath, "old.txt") != "old" {
+		t.Errorf("the install was changed, it has %d entries", len(entries))
+	}
+	if srv.requestCount("/files/a.txt")+srv.requestCount("/files/b.txt") != 0 {
+		t.Error("files were downloaded")
+	}
+
+	srv.update(func(list *fileListYaml, _ map[string][]byte) { list.Version = "" })
+	setupTest(t, srv.patchArgs(rootPath, "--manifest-only")...)
+	if err := checkManifest(rootPath); err == nil {
+		t.Error("an invalid filelist passed")
+	}
+}
+
+func TestSizeWarnings(t *testing.T) {
+	if strconv.IntSize == 32 {
+		t.Skip("implausible sizes don't fit a 32 bit uint")
+	}
+	huge := uint64(maxPlausibleSize) * 4
+	tests := []struct {
+		name  string
+		entry fileEntry
+		want  int
+	}{
+		{"zero", fileEntry{Name: "unknown.txt", MD5: md5Hex("a")}, 0},
+		{"empty", fileEntry{Name: "empty.txt", MD5: emptyMD5}, 0},
+		{"normal", fileEntry{Name: "a.txt", MD5: md5Hex("a"), Size: 1}, 0},
+		{"implausibly large", fileEntry{Name: "huge.txt", MD5: md5Hex("a"), Size: uint(huge)}, 1},
+		{"empty with a size", fileEntry{Name: "empty.txt", MD5: emptyMD5, Size: 10}, 1},
+	}
+	for _, test := range tests {
+		list := fileListYaml{Downloads: []fileEntry{test.entry}}
+		if got := list.sizeWarnings(); len(got) != test.want {
+			t.Errorf("%s: got warnings %q, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSizeMismatchWarning(t *testing.T) {
+	tests := []struct {
+		size uint
+		n    int
+		want string
+	}{
+		{0, 100, ""},
+		{100, 100, ""},
+		{100, 90, "a.txt is 90 bytes, but the filelist says 100"},
+		{100, 102400, "a.txt is 102400 bytes, but the filelist says 100, the filelist seems to use kilobytes instead of bytes"},
+	}
+	for _, test := range tests {
+		if got := sizeMismatchWarning(fileEntry{Name: "a.txt", Size: test.size}, test.n); got != test.want {
+			t.Errorf("Size %d, got %d bytes: warning %q, want %q", test.size, test.n, got, test.want)
+		}
+	}
+}
+
+func TestEmptyNameNeverTargetsRoot(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a"})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Deletes = []fileEntry{{Name: ""}, {Name: " "}, {Name: "."}, {Name: "sub/.."}, {Name: "old.txt"}}
+		list.Downloads = append(list.Downloads, fileEntry{Name: "", MD5: md5Hex("a")})
+	})
+	rootPath := t.TempDir()
+	writeTestFiles(t, rootPath, map[string]string{"old.txt": "old", "keep.txt": "keep", "sub/file.txt": "file"})
+
+	for _, extra := range [][]string{nil, {"--skip-validation"}} {
+		out := setupTest(t, srv.patchArgs(rootPath, extra...)...)
+		_, err := patchRoot(rootPath, time.Time{})
+		if (err == nil) != (extra != nil) {
+			t.Errorf("with %q: patchRoot() = %v", extra, err)
+		}
+		if readTestFile(t, rootPath, "keep.txt") != "keep" || readTestFile(t, rootPath, "sub/file.txt") != "file" {
+			t.Fatalf("with %q: files of the root were removed:\n%s", extra, out)
+		}
+	}
+	if readTestFile(t, rootPath, "old.txt") != "<missing>" || readTestFile(t, rootPath, "a.txt") != "a" {
+		t.Error("--skip-validation did not apply the safe entries")
+	}
+}
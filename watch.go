@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// watchForUpdates checks the filelists of roots every --refresh-interval
+// until interrupted, patching the roots whose version differs from the one
+// last applied to them. It returns whether the last patch of a root failed.
+func watchForUpdates(roots []string, since time.Time, reports []*runReport, quietOutput *quietBuffer) bool {
+	applied := make([]string, len(roots))
+	failed := make([]bool, len(roots))
+	for i, report := range reports {
+		if report != nil && len(report.Failed) == 0 && report.Aborted == "" {
+			applied[i] = report.Version
+		} else {
+			failed[i] = true
+		}
+	}
+	refresh := arg.RefreshManifest
+	fmt.Fprintf(stdout, "Checking for updates every %s, press Ctrl+C to stop\n", arg.RefreshInterval)
+	for {
+		sleepUnlessCancelled(arg.RefreshInterval)
+		if cancelled() {
+			break
+		}
+		outdated := []int{}
+		arg.RefreshManifest = true
+		for i, rootPath := range roots {
+			list, err := loadFileList(rootPath)
+			if err != nil {
+				log.Println("WARNING: could not check for updates:", err)
+				continue
+			}
+			if list.Version != applied[i] {
+				fmt.Fprintf(stdout, "Filelist of %s changed to version %s\n", rootPath, list.Version)
+				outdated = append(outdated, i)
+			}
+		}
+		arg.RefreshManifest = refresh
+		if len(outdated) == 0 {
+			continue
+		}
+		outdatedRoots := make([]string, len(outdated))
+		for j, i := range outdated {
+			outdatedRoots[j] = roots[i]
+		}
+		resetRunState()
+		reports, anyFailed, changed := patchRoots(outdatedRoots, since)
+		for j, i := range outdated {
+			report := reports[j]
+			failed[i] = report == nil || len(report.Failed) > 0 || report.Aborted != ""
+			if !failed[i] {
+				applied[i] = report.Version
+			}
+		}
+		if quietOutput != nil {
+			quietOutput.flush(os.Stdout, changed || anyFailed)
+		}
+	}
+	for _, f := range failed {
+		if f {
+			return true
+		}
+	}
+	return false
+}
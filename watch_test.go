@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshIntervalAppliesNewVersion(t *testing.T) {
+	srv := newTestServer(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	rootPath := t.TempDir()
+	out := setupTest(t, srv.patchArgs(rootPath, "--refresh-interval", "10ms")...)
+	roots := []string{rootPath}
+
+	reports, failed, _ := patchRoots(roots, time.Time{})
+	if failed {
+		t.Fatalf("first run failed: %+v", reports[0])
+	}
+	watchFailed := make(chan bool)
+	go func() { watchFailed <- watchForUpdates(roots, time.Time{}, reports, nil) }()
+
+	// unchanged versions are only checked
+	time.Sleep(50 * time.Millisecond)
+	srv.update(func(list *fileListYaml, files map[string][]byte) {
+		list.Version = "2"
+		list.Downloads[0].MD5, list.Downloads[0].Size = md5Hex("a2"), 2
+		files["a.txt"] = []byte("a2")
+	})
+	// waitFor polls until fn returns true
+	waitFor := func(what string, fn func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !fn() {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	filelistRequests := func() int {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.requests["/filelist.yml"]
+	}
+	waitFor("version 2 was not applied", func() bool { return readTestFile(t, rootPath, "a.txt") == "a2" })
+	// the patch is done once the filelist is checked again
+	checked := filelistRequests()
+	waitFor("the filelist was not checked after patching", func() bool { return filelistRequests() > checked })
+	cancelRun()
+	if <-watchFailed {
+		t.Error("watchForUpdates() reported a failure")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if n := srv.requests["/files/a.txt"]; n != 2 {
+		t.Errorf("a.txt was downloaded %d times, want 2", n)
+	}
+	if n := srv.requests["/files/b.txt"]; n != 1 {
+		t.Errorf("b.txt was downloaded %d times, want 1", n)
+	}
+	if n := srv.requests["/filelist.yml"]; n < 3 {
+		t.Errorf("filelist was fetched %d times, want it checked repeatedly", n)
+	}
+	if n := strings.Count(out.String(), "changed to version 2"); n != 1 {
+		t.Errorf("version change reported %d times, want once:\n%s", n, out)
+	}
+}
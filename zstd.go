@@ -0,0 +1,23 @@
+package main
+
+import "github.com/klauspost/compress/zstd"
+
+// compressionZstd is the fileEntry Compression of zstd compressed files.
+const compressionZstd = "zstd"
+
+// zstdDecompress decompresses the Zstandard frames in src, for downloads
+// with Compression zstd. Decompressing stops with an error once the output
+// would be larger than maxSize.
+func zstdDecompress(src []byte, maxSize int64) ([]byte, error) {
+	if maxSize < 1 {
+		// the decoder needs a limit of at least one byte, and the MD5 check
+		// refuses anything it decompresses to beyond the expected empty file
+		maxSize = 1
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(src, nil)
+}
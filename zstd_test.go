@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdLines returns the test input of n lines of file names and hex numbers.
+func zstdLines(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "file%03d.txt %x\n", i, i*i*7919)
+	}
+	return sb.String()
+}
+
+// zstdCompress returns s compressed as a zstd frame.
+func zstdCompress(t *testing.T, s string) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll([]byte(s), nil)
+}
+
+func TestZstdDecompress(t *testing.T) {
+	want := zstdLines(100)
+	got, err := zstdDecompress(zstdCompress(t, want), int64(len(want)))
+	if err != nil || string(got) != want {
+		t.Errorf("zstdDecompress() = %d bytes, %v, want %d bytes", len(got), err, len(want))
+	}
+	if got, err := zstdDecompress(zstdCompress(t, want), int64(len(want)-1)); err == nil {
+		t.Errorf("decompressed %d bytes beyond the limit without an error", len(got))
+	}
+	if got, err := zstdDecompress([]byte("plain text, not compressed"), 1<<20); err == nil {
+		t.Errorf("decompressed plain text to %q without an error", got)
+	}
+	if got, err := zstdDecompress(zstdCompress(t, ""), 0); err != nil || len(got) != 0 {
+		t.Errorf("zstdDecompress() of an empty file = %q, %v", got, err)
+	}
+}
+
+func TestZstdDownload(t *testing.T) {
+	want := zstdLines(100)
+	srv := newTestServer(t, map[string]string{"files.txt.zst": string(zstdCompress(t, want))})
+	srv.update(func(list *fileListYaml, _ map[string][]byte) {
+		list.Downloads = []fileEntry{{Name: "files.txt", MD5: md5Hex(want), Size: uint(len(want)), Compression: compressionZstd}}
+	})
+	rootPath := t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath)...)
+
+	report, err := patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || readTestFile(t, rootPath, "files.txt") != want {
+		t.Errorf("failed %+v, files.txt = %q", report.Failed, readTestFile(t, rootPath, "files.txt"))
+	}
+
+	// the MD5 is checked after decompressing
+	srv.update(func(_ *fileListYaml, files map[string][]byte) {
+		files["files.txt.zst"] = zstdCompress(t, zstdLines(20))
+	})
+	rootPath = t.TempDir()
+	setupTest(t, srv.patchArgs(rootPath, "--retries", "0")...)
+	report, err = patchRoot(rootPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || !strings.Contains(report.Failed[0].Error, "got MD5 "+md5Hex(zstdLines(20))) {
+		t.Errorf("failed %+v, want an MD5 mismatch of the decompressed data", report.Failed)
+	}
+}